@@ -107,3 +107,44 @@ func (this *AESTool) WriteByBase64(data string) error {
 func (this *AESTool) ReadByBase64() string {
 	return base64.StdEncoding.EncodeToString(this.Buffer.Bytes())
 }
+
+func (this *AESTool) SealGCM(data []byte) error {
+	if gcm, err := cipher.NewGCM(this.block); nil == err {
+		//
+		this.Buffer.Reset()
+		//
+		nonce := make([]byte, gcm.NonceSize())
+		//
+		if _, err := io.ReadFull(rand.Reader, nonce); nil != err {
+			return err
+		}
+		//
+		this.Buffer.Write(gcm.Seal(nonce, nonce, data, nil))
+		//
+		return nil
+	} else {
+		return err
+	}
+}
+
+func (this *AESTool) OpenGCM(data []byte) error {
+	if gcm, err := cipher.NewGCM(this.block); nil == err {
+		//
+		this.Buffer.Reset()
+		//
+		if n := gcm.NonceSize(); n <= len(data) {
+			if result, err := gcm.Open(nil, data[:n], data[n:], nil); nil == err {
+				//
+				this.Buffer.Write(result)
+				//
+				return nil
+			} else {
+				return err
+			}
+		}
+		//
+		return io.ErrUnexpectedEOF
+	} else {
+		return err
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"mime/multipart"
 	"net"
 	"net/http"
@@ -35,6 +36,19 @@ func main() {
 
 	defer logs.Close()
 
+	// 子命令
+	if 1 < len(os.Args) {
+		switch os.Args[1] {
+		case "sqlite-restore":
+			// 任一文件导入失败时以非0状态退出，os.Exit不执行defer，需先关闭日志
+			if !sqliteRestore(os.Args[2:]) {
+				logs.Close()
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	logs.Info("hello utils")
 
 	testAES()
@@ -478,6 +492,52 @@ func testHash() {
 	logs.Info(hash.HashToString("sha512", "123", "456", 123, 456))
 }
 
+func sqliteRestore(args []string) bool {
+	if 2 > len(args) {
+		logs.Error("usage: %s sqlite-restore <database> <dump.json>... [-skip|-replace|-fail]", os.Args[0])
+		return false
+	}
+
+	policy := sqlite.ConflictFail
+
+	var list []string
+
+	for _, item := range args[1:] {
+		switch item {
+		case "-skip":
+			policy = sqlite.ConflictSkip
+		case "-replace":
+			policy = sqlite.ConflictReplace
+		case "-fail":
+			policy = sqlite.ConflictFail
+		default:
+			list = append(list, item)
+		}
+	}
+
+	if db, err := sql.Open("sqlite3", args[0]); nil == err {
+		defer db.Close()
+
+		ok := true
+
+		for _, item := range list {
+			if n, err := sqlite.SQLiteRestoreJSON(db, item, policy); nil == err {
+				logs.Info("%s: 导入%d行", item, n)
+			} else {
+				logs.Error("%s: %v", item, err)
+
+				ok = false
+			}
+		}
+
+		return ok
+	} else {
+		logs.Error(err)
+	}
+
+	return false
+}
+
 func testSQLite() {
 	if db := sqlite.NewSQLiteDB(
 		sqlite.WithBackup("test.db", 10, 2048, 32),
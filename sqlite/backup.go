@@ -1,22 +1,46 @@
 package sqlite
 
 import (
+	"context"
 	"time"
 
 	"github.com/mattn/go-sqlite3"
 )
 
 func SQLiteBackup(master, slave *sqlite3.SQLiteConn, step, delay int) error {
+	return SQLiteBackupContext(context.Background(), master, slave, step, delay, nil)
+}
+
+// 可取消的备份，每步完成后以剩余页数及总页数调用progress，ctx结束时放弃备份，目标数据库保持不变
+func SQLiteBackupContext(ctx context.Context, master, slave *sqlite3.SQLiteConn, step, delay int, progress func(remaining, total int)) error {
 	if bk, err := slave.Backup("main", master, "main"); nil == err {
 		//
 		defer bk.Finish()
 		//
 		for {
+			//
+			if err := ctx.Err(); nil != err {
+				return err
+			}
+			//
 			if ok, err := bk.Step(step); nil == err {
+				//
+				if nil != progress {
+					progress(bk.Remaining(), bk.PageCount())
+				}
+				//
 				if ok {
 					return nil
 				} else {
-					time.Sleep(time.Duration(delay) * time.Millisecond)
+					//
+					timer := time.NewTimer(time.Duration(delay) * time.Millisecond)
+					//
+					select {
+					case <-ctx.Done():
+						timer.Stop()
+						return ctx.Err()
+					case <-timer.C:
+					}
 				}
 			} else {
 				return err
@@ -0,0 +1,91 @@
+package sqlite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	testSeq uint64
+)
+
+// 未关闭的共享内存数据库在进程内一直存在，重复运行(-count)时需要不同的名称
+func testName(t *testing.T) string {
+	return fmt.Sprintf("%s_%d", t.Name(), atomic.AddUint64(&testSeq, 1))
+}
+
+// 自动备份进行中时关闭数据库，等待时间不超过关闭超时
+func TestCloseDuringAutoBackup(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "backup")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	backup := filepath.Join(dir, "test.db")
+	// 空文件表示备份时数据库为空
+	if err := ioutil.WriteFile(backup, nil, 0644); nil != err {
+		t.Fatal(err)
+	}
+	//
+	started := make(chan struct{}, 1)
+	//
+	db := NewSQLiteDB(
+		WithName(testName(t)),
+		WithBackup(backup),
+		WithBackupDelay(10*time.Millisecond),
+		WithCloseTimeout(200*time.Millisecond),
+		// 每步500毫秒，完整备份需要数秒
+		WithBackupProgress(func(remaining, total int) {
+			//
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			//
+			time.Sleep(500 * time.Millisecond)
+		}),
+	)
+	//
+	conn, err := db.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn.Exec("CREATE TABLE t (data BLOB);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := db.StartBackup(true); nil != err {
+		t.Fatal(err)
+	}
+	// 等待自动备份开始监测
+	time.Sleep(100 * time.Millisecond)
+	// 约8000页，每步1024页
+	if _, err := conn.Exec("WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM n WHERE 4000 > i) INSERT INTO t SELECT zeroblob(4096) FROM n;"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("auto backup not started")
+	}
+	//
+	start := time.Now()
+	//
+	db.Close()
+	//
+	if d := time.Since(start); time.Second < d {
+		t.Fatalf("close took %v", d)
+	}
+}
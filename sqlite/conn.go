@@ -2,17 +2,66 @@ package sqlite
 
 import (
 	"container/list"
+	"fmt"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/elitah/utils/logs"
 
 	"github.com/mattn/go-sqlite3"
 )
 
+const (
+	// 驱动未导出SQLITE_RECURSIVE，WITH RECURSIVE查询需要该权限
+	sqliteRecursive = 33
+)
+
+type sqliteChange struct {
+	op    int
+	db    string
+	table string
+	rowid int64
+	time  time.Time
+}
+
 type sqliteRawConnStore struct {
 	sync.RWMutex
 
-	list list.List
+	// 变化通知的通道，关闭后不再发送
+	noticeLock   sync.Mutex
+	list         list.List
+	noticeClosed bool
 
 	conn *sqlite3.SQLiteConn
+
+	track   bool
+	changes map[string]map[int64]int
+
+	pending []sqliteChange
+
+	journal *sqliteJournal
+	// 已安装日志触发器的表及触发器传入的列，这些表的变化在语句执行时同步取得
+	triggers map[string][]string
+	// 安装触发器后表结构发生过变化的表，在重新安装前同时按行号记录
+	stale map[string]bool
+	// 当前事务中由触发器取得的记录，提交前写入日志
+	records []*sqliteJournalRecord
+	// 没有触发器的表的变化，提交后异步读取
+	unjournaled []sqliteChange
+
+	// 正在准备DROP TABLE的表，其随后的删除检查不能忽略
+	dropping string
+
+	// 查看接口执行外部SQL期间只允许读取
+	readonly bool
+
+	replicas map[*sqliteReplicaStream]bool
+
+	subLock sync.RWMutex
+	subs    map[*Subscription]bool
+
+	stats *sqliteStats
 }
 
 func (this *sqliteRawConnStore) Set(conn *sqlite3.SQLiteConn) {
@@ -24,8 +73,22 @@ func (this *sqliteRawConnStore) Set(conn *sqlite3.SQLiteConn) {
 	}
 
 	conn.RegisterUpdateHook(this.HandleUpdate)
+	conn.RegisterCommitHook(this.HandleCommit)
+	conn.RegisterRollbackHook(this.HandleRollback)
+	conn.RegisterAuthorizer(this.HandleAuthorize)
+
+	if err := conn.RegisterFunc(journalFunc, this.HandleJournal, false); nil != err {
+		logs.Error(err)
+	}
 
 	this.conn = conn
+
+	// 临时触发器随连接消失，需要重新安装
+	this.triggers = nil
+
+	if nil != this.journal {
+		this.journal.Refresh()
+	}
 }
 
 func (this *sqliteRawConnStore) Get() *sqlite3.SQLiteConn {
@@ -36,27 +99,394 @@ func (this *sqliteRawConnStore) Get() *sqlite3.SQLiteConn {
 }
 
 func (this *sqliteRawConnStore) RegisterNotice(ch chan string) {
+	this.noticeLock.Lock()
+	defer this.noticeLock.Unlock()
+
+	if this.noticeClosed {
+		close(ch)
+		return
+	}
+
 	this.list.PushBack(ch)
 }
 
+func (this *sqliteRawConnStore) notice(table string) {
+	this.noticeLock.Lock()
+	defer this.noticeLock.Unlock()
+
+	for e := this.list.Front(); nil != e; e = e.Next() {
+		if ch, ok := e.Value.(chan string); ok {
+			if cap(ch) > len(ch) {
+				ch <- table
+			}
+		}
+	}
+}
+
+func (this *sqliteRawConnStore) EnableTrack() {
+	this.Lock()
+	defer this.Unlock()
+
+	this.track = true
+}
+
+func (this *sqliteRawConnStore) SetJournal(j *sqliteJournal) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.journal = j
+	this.triggers = nil
+	this.stale = nil
+	this.records = nil
+	this.unjournaled = nil
+}
+
+// 由安装触发器的事务调用，之后这些表的变化由触发器同步记录
+func (this *sqliteRawConnStore) SetTriggers(triggers map[string][]string) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.triggers = triggers
+	this.stale = nil
+}
+
+// 变化是否已由触发器同步记录，调用者需持有锁
+func (this *sqliteRawConnStore) journaled(table string) bool {
+	if _, ok := this.triggers[table]; ok {
+		return !this.stale[table]
+	}
+	return false
+}
+
+func (this *sqliteRawConnStore) TakeChanges() (changes map[string]map[int64]int) {
+	this.Lock()
+	defer this.Unlock()
+
+	changes, this.changes = this.changes, nil
+
+	return
+}
+
+func (this *sqliteRawConnStore) MergeChanges(changes map[string]map[int64]int) {
+	this.Lock()
+	defer this.Unlock()
+
+	for table, rows := range changes {
+		for rowid, op := range rows {
+			this.record(op, table, rowid)
+		}
+	}
+}
+
+func (this *sqliteRawConnStore) record(op int, table string, rowid int64) {
+	//
+	if nil == this.changes {
+		this.changes = make(map[string]map[int64]int)
+	}
+	//
+	rows, ok := this.changes[table]
+	//
+	if !ok {
+		//
+		rows = make(map[int64]int)
+		//
+		this.changes[table] = rows
+	}
+	// 同一行只保留最后一次操作
+	rows[rowid] = op
+}
+
 func (this *sqliteRawConnStore) HandleUpdate(op int, db string, table string, rowid int64) {
-	if "temp" != db {
-		for e := this.list.Front(); nil != e; e = e.Next() {
-			if ch, ok := e.Value.(chan string); ok {
-				if cap(ch) > len(ch) {
-					ch <- table
+	if "temp" != db && incrementalSchema != db {
+		//
+		if nil != this.stats {
+			this.stats.change(op, table, time.Now())
+		}
+		// 记录变化的行，供增量备份使用
+		this.Lock()
+		if this.track {
+			this.record(op, table, rowid)
+		}
+		// 没有触发器的表只能在提交后读取行内容
+		if nil != this.journal && !this.journaled(table) {
+			this.unjournaled = append(this.unjournaled, sqliteChange{
+				op:    op,
+				db:    db,
+				table: table,
+				rowid: rowid,
+				time:  time.Now(),
+			})
+		}
+		// 事务提交后才发送到备机及通知订阅者
+		if 0 < len(this.replicas) || this.subscribed() {
+			this.pending = append(this.pending, sqliteChange{
+				op:    op,
+				db:    db,
+				table: table,
+				rowid: rowid,
+				time:  time.Now(),
+			})
+		}
+		this.Unlock()
+		//
+		this.notice(table)
+	}
+}
+
+// 不带条件的DELETE会使用truncate优化而不触发更新钩子，返回SQLITE_IGNORE可以禁用该优化
+// 只在订阅者、备机、增量备份或日志需要逐行的变化时禁用，该检查在准备语句时进行
+func (this *sqliteRawConnStore) HandleAuthorize(op int, arg1, arg2, arg3 string) int {
+	if this.isReadOnly() {
+		return sqliteReadOnlyAuthorize(op, arg2)
+	}
+	switch op {
+	case sqlite3.SQLITE_DELETE:
+		// DROP TABLE同样检查删除权限，忽略时删除表被静默取消
+		if this.takeDropping(arg1) {
+			return sqlite3.SQLITE_OK
+		}
+		// 删除触发器等操作会删除sqlite_temp_master中的行，不能忽略
+		if !strings.HasPrefix(arg1, "sqlite_") && this.rowDeletes() {
+			return sqlite3.SQLITE_IGNORE
+		}
+	case sqlite3.SQLITE_DROP_TABLE:
+		this.Lock()
+		this.dropping = arg1
+		this.Unlock()
+		this.markStale(arg1)
+	case sqlite3.SQLITE_CREATE_TABLE:
+		this.markStale(arg1)
+	case sqlite3.SQLITE_ALTER_TABLE:
+		this.markStale(arg2)
+	}
+	return sqlite3.SQLITE_OK
+}
+
+// 是否需要逐行删除以触发更新钩子
+func (this *sqliteRawConnStore) rowDeletes() bool {
+	this.RLock()
+	//
+	flag := this.track || nil != this.journal || 0 < len(this.replicas)
+	//
+	this.RUnlock()
+	//
+	return flag || this.subscribed()
+}
+
+// 调用者须独占连接，期间准备的语句只能读取
+func (this *sqliteRawConnStore) SetReadOnly(flag bool) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.readonly = flag
+}
+
+func (this *sqliteRawConnStore) isReadOnly() bool {
+	this.RLock()
+	defer this.RUnlock()
+
+	return this.readonly
+}
+
+// 只允许查询、读取列及调用函数，内部使用的函数及加载扩展除外
+// ATTACH、PRAGMA及所有修改都被拒绝
+func sqliteReadOnlyAuthorize(op int, arg2 string) int {
+	switch op {
+	case sqlite3.SQLITE_SELECT, sqlite3.SQLITE_READ, sqliteRecursive:
+		return sqlite3.SQLITE_OK
+	case sqlite3.SQLITE_FUNCTION:
+		if name := strings.ToLower(arg2); !strings.HasPrefix(name, "__") && "load_extension" != name {
+			return sqlite3.SQLITE_OK
+		}
+	}
+	return sqlite3.SQLITE_DENY
+}
+
+func (this *sqliteRawConnStore) takeDropping(table string) bool {
+	this.Lock()
+	defer this.Unlock()
+
+	if "" != this.dropping && table == this.dropping {
+		this.dropping = ""
+		return true
+	}
+
+	return false
+}
+
+// 表结构变化后触发器传入的列可能已不完整，在重新安装前回退到按行号记录
+func (this *sqliteRawConnStore) markStale(table string) {
+	this.Lock()
+	defer this.Unlock()
+
+	if nil != this.journal {
+		if nil == this.stale {
+			this.stale = make(map[string]bool)
+		}
+		this.stale[table] = true
+	}
+}
+
+// 由日志触发器在语句执行时调用，values为触发器安装时各列的值
+func (this *sqliteRawConnStore) HandleJournal(op int, table string, old, rowid int64, values ...interface{}) int {
+	this.Lock()
+	defer this.Unlock()
+
+	if nil == this.journal {
+		return 0
+	}
+
+	// 更新了行号时旧行视为删除
+	if sqlite3.SQLITE_UPDATE == op && old != rowid {
+		this.records = append(this.records, &sqliteJournalRecord{
+			Op:    sqlite3.SQLITE_DELETE,
+			Table: table,
+			RowID: old,
+		})
+	}
+
+	record := &sqliteJournalRecord{
+		Op:    op,
+		Table: table,
+		RowID: rowid,
+	}
+
+	if sqlite3.SQLITE_DELETE != op {
+		if columns, ok := this.triggers[table]; ok && len(columns) == len(values) {
+			record.Columns = columns
+			record.Values = make([]sqliteValue, len(values))
+			for i, v := range values {
+				if _v, err := newSQLiteValue(v); nil == err {
+					record.Values[i] = _v
+				} else {
+					logs.Error(err)
+					return 0
 				}
 			}
+		} else {
+			// 不会发生，由按行号记录的变化补全
+			logs.Error(fmt.Errorf("unexpected journal trigger for table %s", table))
+			return 0
 		}
 	}
+
+	this.records = append(this.records, record)
+
+	return 0
+}
+
+func (this *sqliteRawConnStore) HandleCommit() int {
+	this.Lock()
+
+	j := this.journal
+
+	records, unjournaled := this.records, this.unjournaled
+
+	this.records, this.unjournaled = nil, nil
+
+	refresh := 0 < len(this.stale)
+
+	this.Unlock()
+
+	if nil != j {
+		// 记录写入磁盘后才允许提交，写入失败时回滚事务
+		if 0 < len(records) {
+			if err := j.Append(records); nil != err {
+				logs.Error(fmt.Errorf("unable write journal, transaction rolled back, %w", err))
+				return 1
+			}
+		}
+		if 0 < len(unjournaled) {
+			j.Push(unjournaled)
+		}
+		if refresh {
+			j.Refresh()
+		}
+	}
+
+	this.Lock()
+
+	list := this.pending
+
+	if 0 < len(list) {
+		for r, _ := range this.replicas {
+			r.Push(list)
+		}
+		this.pending = nil
+	}
+
+	this.Unlock()
+
+	// 阻塞策略的订阅者可能阻塞，不能持有锁
+	if 0 < len(list) {
+		this.publish(list)
+	}
+
+	return 0
+}
+
+func (this *sqliteRawConnStore) HandleRollback() {
+	this.Lock()
+	defer this.Unlock()
+
+	this.pending = nil
+	this.records = nil
+	this.unjournaled = nil
+}
+
+func (this *sqliteRawConnStore) AddReplica(r *sqliteReplicaStream) {
+	this.Lock()
+	defer this.Unlock()
+
+	if nil == this.replicas {
+		this.replicas = make(map[*sqliteReplicaStream]bool)
+	}
+
+	this.replicas[r] = true
+}
+
+func (this *sqliteRawConnStore) RemoveReplica(r *sqliteReplicaStream) {
+	this.Lock()
+	defer this.Unlock()
+
+	delete(this.replicas, r)
 }
 
 func (this *sqliteRawConnStore) Close() {
-	for e := this.list.Front(); nil != e; e = e.Next() {
+	// 先停止发送再关闭通道
+	this.noticeLock.Lock()
+
+	this.noticeClosed = true
+
+	for e := this.list.Front(); nil != e; e = this.list.Front() {
 		if result := this.list.Remove(e); nil != result {
 			if ch, ok := result.(chan string); ok {
 				close(ch)
 			}
 		}
 	}
+
+	this.noticeLock.Unlock()
+
+	this.subLock.RLock()
+
+	list := make([]*Subscription, 0, len(this.subs))
+
+	for sub, _ := range this.subs {
+		list = append(list, sub)
+	}
+
+	this.subLock.RUnlock()
+
+	for _, sub := range list {
+		sub.Cancel()
+	}
+
+	this.Lock()
+
+	for r, _ := range this.replicas {
+		r.Close()
+	}
+
+	this.Unlock()
 }
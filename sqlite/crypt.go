@@ -0,0 +1,292 @@
+package sqlite
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/elitah/utils/aes"
+	"github.com/elitah/utils/logs"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// 加密备份文件头
+	cryptMagic = "SQLITE-AES-GCM-1"
+
+	// 未加密的SQLite文件头
+	sqliteMagic = "SQLite format 3\x00"
+
+	// 明文临时文件名为".备份文件名.plain-随机数"
+	cryptTempSuffix = ".plain-"
+)
+
+var (
+	cryptMemoryID uint64
+
+	EBackupKey = errors.New("unable decrypt backup, wrong key or corrupted file")
+)
+
+// 使用AES-GCM加密备份文件及日志，key为当前密钥，old为轮换前的密钥，仅用于解密
+// 加密后不支持增量备份，任一密钥无效时StartBackup及Backup返回错误，不会写入明文备份
+func WithEncryption(key string, old ...string) Option {
+	//
+	keys := append([]string{key}, old...)
+	//
+	for i, item := range keys {
+		if nil == aes.NewAESTool(item) {
+			//
+			err := fmt.Errorf("invalid encryption key (%d)", i)
+			//
+			logs.Error(err)
+			//
+			return func(opts *options) {
+				opts.crypt_keys = nil
+				opts.crypt_err = err
+			}
+		}
+	}
+	//
+	return func(opts *options) {
+		opts.crypt_keys = keys
+		opts.crypt_err = nil
+	}
+}
+
+func (this *SQLiteDB) encrypted() bool {
+	return 0 < len(this.opts.crypt_keys)
+}
+
+// 使用当前密钥加密
+func (this *SQLiteDB) seal(data []byte) ([]byte, error) {
+	if tool := aes.NewAESTool(this.opts.crypt_keys[0]); nil != tool {
+		if err := tool.SealGCM(data); nil == err {
+			return tool.Bytes(), nil
+		} else {
+			return nil, err
+		}
+	}
+	return nil, EBackupKey
+}
+
+// 依次尝试当前及轮换前的密钥，返回成功解密的密钥序号
+func (this *SQLiteDB) unseal(data []byte) ([]byte, int, error) {
+	for i, key := range this.opts.crypt_keys {
+		if tool := aes.NewAESTool(key); nil != tool {
+			if err := tool.OpenGCM(data); nil == err {
+				return tool.Bytes(), i, nil
+			}
+		}
+	}
+	return nil, -1, EBackupKey
+}
+
+// 返回按顺序解密日志记录的函数，启用加密前写入的明文记录只能出现在第一条加密记录之前
+// 之后出现的明文记录说明日志被修改，返回错误而不是回放
+func (this *SQLiteDB) journalUnseal() func([]byte) ([]byte, error) {
+	//
+	sealed := false
+	//
+	return func(data []byte) ([]byte, error) {
+		if result, _, err := this.unseal(data); nil == err {
+			//
+			sealed = true
+			//
+			return result, nil
+		} else if !sealed && json.Valid(data) {
+			return data, nil
+		} else if sealed {
+			return nil, fmt.Errorf("%w, plaintext record after encrypted records", EJournalCorrupt)
+		} else {
+			return nil, err
+		}
+	}
+}
+
+// 加密明文数据库文件plain并写入dst，plain为临时文件，读取后立即删除
+func (this *SQLiteDB) sealFile(plain, dst string) error {
+	//
+	data, err := ioutil.ReadFile(plain)
+	//
+	os.Remove(plain)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	if result, err := this.seal(data); nil == err {
+		//
+		tmp := dst + ".tmp"
+		//
+		if err := ioutil.WriteFile(tmp, append([]byte(cryptMagic), result...), 0600); nil == err {
+			return os.Rename(tmp, dst)
+		} else {
+			os.Remove(tmp)
+			return err
+		}
+	} else {
+		return err
+	}
+}
+
+// 加密数据源dsn对应的数据库并写入dst
+func (this *SQLiteDB) sealDB(dsn, dst string) error {
+	//
+	tmp, err := this.plainTemp()
+	//
+	if nil != err {
+		return err
+	}
+	//
+	defer os.Remove(tmp)
+	//
+	if c, err := (&sqlite3.SQLiteDriver{}).Open(dsn); nil == err {
+		//
+		conn, ok := c.(*sqlite3.SQLiteConn)
+		//
+		if !ok {
+			c.Close()
+			return fmt.Errorf("unexpected connection type %T", c)
+		}
+		//
+		err := sqliteBackupFile(conn, tmp, false, this.opts.backup_step, this.opts.backup_delay)
+		//
+		conn.Close()
+		//
+		if nil != err {
+			return err
+		}
+	} else {
+		return err
+	}
+	//
+	return this.sealFile(tmp, dst)
+}
+
+// 读取备份文件内容，加密文件返回解密后的内容，兼容启用加密前的明文备份
+func (this *SQLiteDB) readPlain(path string) ([]byte, bool, error) {
+	//
+	data, err := ioutil.ReadFile(path)
+	//
+	if nil != err {
+		return nil, false, err
+	}
+	//
+	if !this.encrypted() || bytes.HasPrefix(data, []byte(sqliteMagic)) || 0 == len(data) {
+		return data, false, nil
+	}
+	//
+	if !bytes.HasPrefix(data, []byte(cryptMagic)) {
+		return nil, false, fmt.Errorf("%w, unknown file format", EBackupCorrupt)
+	}
+	//
+	data, i, err := this.unseal(data[len(cryptMagic):])
+	//
+	if nil != err {
+		return nil, true, err
+	}
+	//
+	if 0 < i {
+		logs.Warn("备份文件%s使用旧密钥(%d)解密成功，下次备份将使用新密钥", path, i)
+	}
+	//
+	return data, true, nil
+}
+
+// 返回可直接打开的明文数据源，加密文件解密后载入独立的内存数据库，调用cleanup后释放
+// 返回的encrypted表示源文件是否为加密文件
+func (this *SQLiteDB) openFile(path string) (plain string, cleanup func(), encrypted bool, err error) {
+	//
+	cleanup = func() {}
+	//
+	if !this.encrypted() {
+		return path, cleanup, false, nil
+	}
+	//
+	data, encrypted, err := this.readPlain(path)
+	//
+	if nil != err || !encrypted {
+		return path, cleanup, false, err
+	}
+	//
+	if plain, cleanup, err = this.loadMemory(data); nil != err {
+		return "", func() {}, true, err
+	}
+	//
+	return plain, cleanup, true, nil
+}
+
+// 将数据库文件内容载入独立的内存数据库，返回可直接打开的数据源，调用cleanup后释放
+// 驱动不支持直接从内存载入，明文只在载入期间写入权限为0600的临时文件
+func (this *SQLiteDB) loadMemory(data []byte) (string, func(), error) {
+	//
+	tmp, err := this.plainTemp()
+	//
+	if nil != err {
+		return "", nil, err
+	}
+	//
+	defer os.Remove(tmp)
+	//
+	if err := ioutil.WriteFile(tmp, data, 0600); nil != err {
+		return "", nil, err
+	}
+	//
+	dsn := fmt.Sprintf("file:sqlite_plain_%p_%d?mode=memory&cache=shared", this, atomic.AddUint64(&cryptMemoryID, 1))
+	// 共享缓存的内存数据库在最后一个连接关闭后释放
+	if c, err := (&sqlite3.SQLiteDriver{}).Open(dsn); nil == err {
+		//
+		conn, ok := c.(*sqlite3.SQLiteConn)
+		//
+		if !ok {
+			c.Close()
+			return "", nil, fmt.Errorf("unexpected connection type %T", c)
+		}
+		//
+		if err := sqliteBackupFile(conn, tmp, true, this.opts.backup_step, this.opts.backup_delay); nil != err {
+			conn.Close()
+			return "", nil, err
+		}
+		//
+		return dsn, func() {
+			conn.Close()
+		}, nil
+	} else {
+		return "", nil, err
+	}
+}
+
+// 在备份目录中创建权限为0600的明文临时文件
+func (this *SQLiteDB) plainTemp() (string, error) {
+	//
+	dir, name := filepath.Split(this.opts.backup_path)
+	//
+	if f, err := ioutil.TempFile(dir, "."+name+cryptTempSuffix+"*"); nil == err {
+		//
+		f.Close()
+		//
+		return f.Name(), nil
+	} else {
+		return "", err
+	}
+}
+
+// 删除进程崩溃后残留的明文临时文件
+func (this *SQLiteDB) sweepPlain() {
+	//
+	dir, name := filepath.Split(this.opts.backup_path)
+	//
+	if list, err := filepath.Glob(filepath.Join(dir, "."+name+cryptTempSuffix+"*")); nil == err {
+		for _, item := range list {
+			if err := os.Remove(item); nil == err {
+				logs.Warn("已删除残留的明文临时文件%s", item)
+			}
+		}
+	}
+}
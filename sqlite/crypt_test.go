@@ -0,0 +1,129 @@
+package sqlite
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// 加密备份及恢复后目录中不能留下明文文件
+func TestEncryptedBackupNoPlaintext(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "crypt")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	backup := filepath.Join(dir, "test.db")
+	//
+	db1 := NewSQLiteDB(WithName(t.Name()+"_1"), WithBackup(backup), WithEncryption("0123456789abcdef"))
+	//
+	conn1, err := db1.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn1.Exec("CREATE TABLE t (v TEXT); INSERT INTO t VALUES ('secret-value');"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if err := db1.Backup(); nil != err {
+		t.Fatal(err)
+	}
+	//
+	db1.Close()
+	//
+	if data, err := ioutil.ReadFile(backup); nil != err {
+		t.Fatal(err)
+	} else if bytes.Contains(data, []byte("secret-value")) {
+		t.Fatal("backup file is not encrypted")
+	}
+	// 模拟异常退出时残留的明文临时文件
+	if err := ioutil.WriteFile(filepath.Join(dir, ".test.db.plain-1"), []byte("secret-value"), 0600); nil != err {
+		t.Fatal(err)
+	}
+	//
+	db2 := NewSQLiteDB(WithName(t.Name()+"_2"), WithBackup(backup), WithEncryption("0123456789abcdef"))
+	//
+	defer db2.Close()
+	//
+	conn2, err := db2.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn2.Exec("CREATE TABLE t (v TEXT);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if n, err := db2.StartBackup(false); nil != err {
+		t.Fatal(err)
+	} else if 1 != n {
+		t.Fatalf("restored %d rows, expected 1", n)
+	}
+	//
+	var names []string
+	//
+	if list, err := ioutil.ReadDir(dir); nil == err {
+		for _, item := range list {
+			names = append(names, item.Name())
+		}
+	} else {
+		t.Fatal(err)
+	}
+	//
+	sort.Strings(names)
+	//
+	if 2 != len(names) || "test.db" != names[0] || "test.db.sha256" != names[1] {
+		t.Fatalf("unexpected files %v", names)
+	}
+}
+
+// 密钥无效时拒绝备份，不能写入明文备份文件
+func TestEncryptionInvalidKey(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "crypt")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	backup := filepath.Join(dir, "test.db")
+	//
+	for i, opt := range []Option{
+		WithEncryption(""),
+		WithEncryption("0123456789abcdef", ""),
+	} {
+		//
+		db := NewSQLiteDB(WithName(fmt.Sprintf("%s_%d", t.Name(), i)), WithBackup(backup), opt)
+		//
+		if _, err := db.GetConn(); nil != err {
+			t.Fatal(err)
+		}
+		//
+		if _, err := db.StartBackup(true); nil == err {
+			t.Fatal("invalid key accepted by StartBackup")
+		}
+		//
+		if err := db.Backup(); nil == err {
+			t.Fatal("invalid key accepted by Backup")
+		}
+		//
+		db.Close()
+		//
+		if _, err := os.Stat(backup); !os.IsNotExist(err) {
+			t.Fatalf("backup file written, %v", err)
+		}
+	}
+}
@@ -0,0 +1,876 @@
+package sqlite
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// 与sqlite3命令行.dump兼容的SQL脚本
+	DumpSQL = iota
+	// 每张表以"#table,表名,建表语句"开头，随后是列名及数据行，NULL写作\N，BLOB写作X'十六进制'
+	// 与这些标记相同或以\开头的文本前加\。CSV不保存数值的存储类型，导入时数值及文本按列的类型亲和性转换，
+	// 如未声明类型的列中的数值导入后为文本，需要原样复制时使用DumpSQL或DumpJSONL
+	DumpCSV
+	// 每张表先输出一行{"table","sql","columns"}，随后每行数据为{"table","row"}
+	// BLOB写作{"$b64":"base64"}，只有该形式的值按BLOB导入
+	DumpJSONL
+)
+
+const (
+	csvTableMarker = "#table"
+	csvNull        = `\N`
+	csvEscape      = `\`
+)
+
+var (
+	csvBlobRegexp = regexp.MustCompile(`^[Xx]'([0-9A-Fa-f]{2})*'$`)
+)
+
+type sqliteDumpLine struct {
+	Table   string        `json:"table"`
+	SQL     string        `json:"sql,omitempty"`
+	Columns []string      `json:"columns,omitempty"`
+	Row     []interface{} `json:"row,omitempty"`
+}
+
+type sqliteDumpTableInfo struct {
+	name string
+	sql  string
+}
+
+// 导出数据库内容，tables为空时导出所有表
+// 先通过备份接口复制到临时文件再从副本导出，写入较慢的w时不占用数据库连接
+func (this *SQLiteDB) Dump(w io.Writer, format int, tables ...string) error {
+	//
+	var fn func(*sql.Tx, io.Writer, []*sqliteDumpTableInfo) error
+	//
+	switch format {
+	case DumpSQL:
+		fn = func(tx *sql.Tx, w io.Writer, list []*sqliteDumpTableInfo) error {
+			return sqliteDumpSQL(tx, w, list, 0 == len(tables))
+		}
+	case DumpCSV:
+		fn = sqliteDumpCSV
+	case DumpJSONL:
+		fn = sqliteDumpJSONL
+	default:
+		return fmt.Errorf("unknown dump format: %d", format)
+	}
+	//
+	f, err := ioutil.TempFile(this.replicaDir(), "dump-*.db")
+	//
+	if nil != err {
+		return err
+	}
+	//
+	path := f.Name()
+	//
+	f.Close()
+	//
+	defer os.Remove(path)
+	//
+	if err := this.snapshot(path, nil); nil != err {
+		return err
+	}
+	//
+	db, err := sql.Open("sqlite3", path)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	defer db.Close()
+	//
+	tx, err := db.Begin()
+	//
+	if nil != err {
+		return err
+	}
+	// 副本只用于读取
+	defer tx.Rollback()
+	//
+	if list, err := sqliteDumpTables(tx, tables); nil == err {
+		return fn(tx, w, list)
+	} else {
+		return err
+	}
+}
+
+func sqliteDumpTables(db *sql.Tx, tables []string) ([]*sqliteDumpTableInfo, error) {
+	//
+	filter := make(map[string]bool)
+	//
+	for _, item := range tables {
+		filter[strings.ToLower(item)] = true
+	}
+	//
+	var list []*sqliteDumpTableInfo
+	//
+	if rows, err := db.Query("SELECT name, sql FROM main.sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' ORDER BY rowid;"); nil == err {
+		//
+		defer rows.Close()
+		//
+		for rows.Next() {
+			//
+			item := &sqliteDumpTableInfo{}
+			//
+			if err := rows.Scan(&item.name, &item.sql); nil != err {
+				return nil, err
+			}
+			//
+			if 0 == len(filter) || filter[strings.ToLower(item.name)] {
+				list = append(list, item)
+				delete(filter, strings.ToLower(item.name))
+			}
+		}
+		//
+		if err := rows.Err(); nil != err {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+	//
+	for name, _ := range filter {
+		return nil, fmt.Errorf("table %s not found", name)
+	}
+	//
+	return list, nil
+}
+
+func sqliteDumpSQL(db *sql.Tx, w io.Writer, list []*sqliteDumpTableInfo, all bool) error {
+	//
+	bw := bufio.NewWriter(w)
+	//
+	bw.WriteString("PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n")
+	//
+	for _, item := range list {
+		//
+		fmt.Fprintf(bw, "%s;\n", item.sql)
+		//
+		if err := sqliteDumpInserts(db, bw, item.name); nil != err {
+			return err
+		}
+	}
+	// 自增序号及索引、触发器、视图只在导出全部表时输出
+	if all {
+		//
+		var exists int
+		//
+		if err := db.QueryRow("SELECT COUNT(*) FROM main.sqlite_master WHERE type='table' AND name='sqlite_sequence';").Scan(&exists); nil != err {
+			return err
+		}
+		//
+		if 0 < exists {
+			//
+			bw.WriteString("DELETE FROM sqlite_sequence;\n")
+			//
+			if err := sqliteDumpInserts(db, bw, "sqlite_sequence"); nil != err {
+				return err
+			}
+		}
+		//
+		if rows, err := db.Query("SELECT sql FROM main.sqlite_master WHERE type IN ('index', 'trigger', 'view') AND sql IS NOT NULL AND name NOT LIKE 'sqlite_%' ORDER BY rowid;"); nil == err {
+			//
+			for rows.Next() {
+				//
+				var s string
+				//
+				if err := rows.Scan(&s); nil != err {
+					rows.Close()
+					return err
+				}
+				//
+				fmt.Fprintf(bw, "%s;\n", s)
+			}
+			//
+			rows.Close()
+			//
+			if err := rows.Err(); nil != err {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+	//
+	bw.WriteString("COMMIT;\n")
+	//
+	return bw.Flush()
+}
+
+// 以SQL字面量输出所有行，类型与内容保持不变
+func sqliteDumpInserts(db *sql.Tx, w io.Writer, table string) error {
+	//
+	columns, err := sqliteTableColumns(db, "main", table)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	if 0 == len(columns) {
+		return nil
+	}
+	//
+	list := make([]string, len(columns))
+	//
+	for i, name := range columns {
+		list[i] = fmt.Sprintf("quote(%s)", sqliteQuote(name))
+	}
+	//
+	if rows, err := db.Query(fmt.Sprintf("SELECT %s FROM main.%s;", strings.Join(list, ", "), sqliteQuote(table))); nil == err {
+		//
+		defer rows.Close()
+		//
+		values := make([]string, len(columns))
+		args := make([]interface{}, len(columns))
+		//
+		for i, _ := range values {
+			args[i] = &values[i]
+		}
+		//
+		for rows.Next() {
+			//
+			if err := rows.Scan(args...); nil != err {
+				return err
+			}
+			//
+			if _, err := fmt.Fprintf(w, "INSERT INTO %s VALUES(%s);\n", sqliteQuote(table), strings.Join(values, ",")); nil != err {
+				return err
+			}
+		}
+		//
+		return rows.Err()
+	} else {
+		return err
+	}
+}
+
+// 遍历表中的所有行，值按列的类型亲和性扫描
+// 查询时在列名前加+，驱动得不到声明类型，不会解析时间或布尔值，读到的是保存的原值
+func sqliteDumpRows(db *sql.Tx, table string, fn func([]string, []interface{}) error) error {
+	//
+	infos, err := sqliteColumnInfos(db, table)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	columns := make([]string, len(infos))
+	list := make([]string, len(infos))
+	//
+	for i, item := range infos {
+		columns[i] = item.name
+		list[i] = "+" + sqliteQuote(item.name)
+	}
+	//
+	if rows, err := db.Query(fmt.Sprintf("SELECT %s FROM main.%s;", strings.Join(list, ", "), sqliteQuote(table))); nil == err {
+		//
+		defer rows.Close()
+		// 先输出表头
+		if err := fn(columns, nil); nil != err {
+			return err
+		}
+		//
+		for rows.Next() {
+			//
+			values := make([]interface{}, len(infos))
+			//
+			for i, _ := range values {
+				values[i] = sqliteScanDecl(infos[i].ctype)
+			}
+			//
+			if err := rows.Scan(values...); nil != err {
+				return err
+			}
+			//
+			if err := fn(columns, values); nil != err {
+				return err
+			}
+		}
+		//
+		return rows.Err()
+	} else {
+		return err
+	}
+}
+
+func sqliteDumpCSV(db *sql.Tx, w io.Writer, list []*sqliteDumpTableInfo) error {
+	//
+	cw := csv.NewWriter(w)
+	//
+	for _, item := range list {
+		//
+		if err := cw.Write([]string{csvTableMarker, item.name, item.sql}); nil != err {
+			return err
+		}
+		//
+		if err := sqliteDumpRows(db, item.name, func(columns []string, values []interface{}) error {
+			//
+			if nil == values {
+				return cw.Write(columns)
+			}
+			//
+			record := make([]string, len(values))
+			//
+			for i, value := range values {
+				if s, err := sqliteCSVValue(value); nil == err {
+					record[i] = s
+				} else {
+					return err
+				}
+			}
+			//
+			return cw.Write(record)
+		}); nil != err {
+			return err
+		}
+	}
+	//
+	cw.Flush()
+	//
+	return cw.Error()
+}
+
+func sqliteCSVValue(value interface{}) (string, error) {
+	//
+	if v, ok := value.(driver.Valuer); ok {
+		if _value, err := v.Value(); nil == err {
+			value = _value
+		} else {
+			return "", err
+		}
+	}
+	//
+	switch v := value.(type) {
+	case nil:
+		return csvNull, nil
+	case []byte:
+		return "X'" + strings.ToUpper(hex.EncodeToString(v)) + "'", nil
+	case string:
+		// 与NULL、BLOB及表头标记区分
+		if strings.HasPrefix(v, csvEscape) || csvTableMarker == v || csvBlobRegexp.MatchString(v) {
+			return csvEscape + v, nil
+		}
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case time.Time:
+		// 与驱动写入时间时使用的格式一致
+		return v.Format("2006-01-02 15:04:05.999999999-07:00"), nil
+	}
+	//
+	return fmt.Sprint(value), nil
+}
+
+func sqliteDumpJSONL(db *sql.Tx, w io.Writer, list []*sqliteDumpTableInfo) error {
+	//
+	bw := bufio.NewWriter(w)
+	//
+	encoder := json.NewEncoder(bw)
+	//
+	for _, item := range list {
+		if err := sqliteDumpRows(db, item.name, func(columns []string, values []interface{}) error {
+			if nil == values {
+				return encoder.Encode(&sqliteDumpLine{
+					Table:   item.name,
+					SQL:     item.sql,
+					Columns: columns,
+				})
+			}
+			return encoder.Encode(&sqliteDumpLine{
+				Table: item.name,
+				Row:   values,
+			})
+		}); nil != err {
+			return err
+		}
+	}
+	//
+	return bw.Flush()
+}
+
+// 导入Dump导出的内容，格式自动识别，返回写入的行数
+// CSV及JSON Lines在同一事务中导入，表不存在时按导出的建表语句创建，与已有的行冲突时整体回滚
+func (this *SQLiteDB) Load(r io.Reader) (int64, error) {
+	//
+	db, err := this.GetConn(true)
+	//
+	if nil != err {
+		return 0, err
+	}
+	//
+	br := bufio.NewReader(r)
+	//
+	for {
+		if c, _, err := br.ReadRune(); nil == err {
+			if !unicode.IsSpace(c) {
+				//
+				br.UnreadRune()
+				//
+				switch c {
+				case '{':
+					return sqliteLoadJSONL(db, br)
+				case '#':
+					return sqliteLoadCSV(db, br)
+				}
+				//
+				return sqliteLoadSQL(db, br)
+			}
+		} else if io.EOF == err {
+			return 0, nil
+		} else {
+			return 0, err
+		}
+	}
+}
+
+func sqliteLoadSQL(db *sql.DB, r *bufio.Reader) (int64, error) {
+	//
+	ctx := context.Background()
+	// 脚本中的事务语句需要在同一连接上执行
+	conn, err := db.Conn(ctx)
+	//
+	if nil != err {
+		return 0, err
+	}
+	//
+	defer conn.Close()
+	//
+	var cnt int64
+	//
+	err = sqliteScanStatements(r, func(query string) error {
+		if result, err := conn.ExecContext(ctx, query); nil == err {
+			// 其余语句返回的是上一条修改语句的行数
+			if sqliteIsDML(query) {
+				if n, err := result.RowsAffected(); nil == err {
+					cnt += n
+				}
+			}
+			return nil
+		} else {
+			return err
+		}
+	})
+	//
+	if nil != err {
+		// 脚本中途失败时回滚未提交的事务
+		conn.ExecContext(ctx, "ROLLBACK;")
+		//
+		return 0, err
+	}
+	//
+	return cnt, nil
+}
+
+// 是否为INSERT、REPLACE、UPDATE或DELETE语句，忽略开头的注释
+func sqliteIsDML(query string) bool {
+	//
+	for {
+		//
+		query = strings.TrimSpace(query)
+		//
+		if strings.HasPrefix(query, "--") {
+			if i := strings.IndexByte(query, '\n'); 0 <= i {
+				query = query[i+1:]
+			} else {
+				return false
+			}
+		} else if strings.HasPrefix(query, "/*") {
+			if i := strings.Index(query, "*/"); 0 <= i {
+				query = query[i+2:]
+			} else {
+				return false
+			}
+		} else {
+			break
+		}
+	}
+	//
+	if i := strings.IndexFunc(query, func(c rune) bool {
+		return !unicode.IsLetter(c)
+	}); 0 <= i {
+		query = query[:i]
+	}
+	//
+	switch strings.ToUpper(query) {
+	case "INSERT", "REPLACE", "UPDATE", "DELETE":
+		return true
+	}
+	//
+	return false
+}
+
+// 按分号拆分SQL语句，忽略引号及注释中的分号，触发器以END;结束
+func sqliteScanStatements(r *bufio.Reader, fn func(string) error) error {
+	//
+	var sb strings.Builder
+	//
+	var quote rune
+	var comment rune
+	//
+	emit := func() error {
+		//
+		query := strings.TrimSpace(sb.String())
+		//
+		sb.Reset()
+		//
+		if "" == strings.Trim(query, "; \t\r\n") {
+			return nil
+		}
+		//
+		return fn(query)
+	}
+	//
+	for {
+		//
+		c, _, err := r.ReadRune()
+		//
+		if nil != err {
+			if io.EOF == err {
+				return emit()
+			}
+			return err
+		}
+		//
+		sb.WriteRune(c)
+		//
+		switch {
+		case '-' == comment:
+			if '\n' == c {
+				comment = 0
+			}
+		case '*' == comment:
+			if '*' == c {
+				if next, _, err := r.ReadRune(); nil == err {
+					if '/' == next {
+						sb.WriteRune(next)
+						comment = 0
+					} else {
+						r.UnreadRune()
+					}
+				}
+			}
+		case 0 != quote:
+			if quote == c {
+				quote = 0
+			}
+		case '\'' == c, '"' == c, '`' == c:
+			quote = c
+		case '[' == c:
+			quote = ']'
+		case '-' == c, '/' == c:
+			if next, _, err := r.ReadRune(); nil == err {
+				if ('-' == c && '-' == next) || ('/' == c && '*' == next) {
+					sb.WriteRune(next)
+					comment = next
+				} else {
+					r.UnreadRune()
+				}
+			}
+		case ';' == c:
+			if sqliteStatementComplete(sb.String()) {
+				if err := emit(); nil != err {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// 触发器内部包含分号，需以END结束
+func sqliteStatementComplete(query string) bool {
+	//
+	fields := strings.Fields(strings.ToUpper(query))
+	//
+	if 2 <= len(fields) && "CREATE" == fields[0] {
+		for i := 1; len(fields) > i && 4 >= i; i++ {
+			if "TRIGGER" == fields[i] {
+				//
+				last := strings.TrimRight(fields[len(fields)-1], ";")
+				//
+				if "" == last && 2 <= len(fields) {
+					last = fields[len(fields)-2]
+				}
+				//
+				return "END" == last
+			}
+		}
+	}
+	//
+	return true
+}
+
+// 导入时需要的表信息
+type sqliteLoadTable struct {
+	name  string
+	stmt  *sql.Stmt
+	types []string
+}
+
+// 准备导入一张表，表不存在时使用create创建
+func sqliteLoadPrepare(tx *sql.Tx, table, create string, columns []string) (*sqliteLoadTable, error) {
+	//
+	var exists int
+	//
+	if err := tx.QueryRow("SELECT COUNT(*) FROM main.sqlite_master WHERE type='table' AND name=?;", table).Scan(&exists); nil != err {
+		return nil, err
+	}
+	//
+	if 0 == exists {
+		if "" == create {
+			return nil, fmt.Errorf("table %s not found", table)
+		}
+		if _, err := tx.Exec(create); nil != err {
+			return nil, err
+		}
+	}
+	//
+	infos, err := sqliteColumnInfos(tx, table)
+	//
+	if nil != err {
+		return nil, err
+	}
+	//
+	result := &sqliteLoadTable{
+		name:  table,
+		types: make([]string, len(columns)),
+	}
+	//
+	for i, name := range columns {
+		//
+		found := false
+		//
+		for _, item := range infos {
+			if strings.EqualFold(name, item.name) {
+				result.types[i] = item.ctype
+				found = true
+				break
+			}
+		}
+		//
+		if !found {
+			return nil, fmt.Errorf("table %s has no column %s", table, name)
+		}
+	}
+	//
+	if 0 == len(columns) {
+		return nil, fmt.Errorf("table %s has no columns", table)
+	}
+	//
+	if stmt, err := tx.Prepare(fmt.Sprintf(
+		"INSERT INTO main.%s (%s) VALUES (?%s);",
+		sqliteQuote(table),
+		sqliteQuoteList(columns),
+		strings.Repeat(", ?", len(columns)-1),
+	)); nil == err {
+		result.stmt = stmt
+	} else {
+		return nil, err
+	}
+	//
+	return result, nil
+}
+
+func sqliteLoadCSV(db *sql.DB, r io.Reader) (int64, error) {
+	//
+	cr := csv.NewReader(r)
+	// 每张表的列数不同
+	cr.FieldsPerRecord = -1
+	//
+	tx, err := db.Begin()
+	//
+	if nil != err {
+		return 0, err
+	}
+	//
+	var cnt int64
+	var table *sqliteLoadTable
+	// 表名与建表语句，下一行为列名
+	var pending []string
+	//
+	fail := func(err error) (int64, error) {
+		if nil != table {
+			table.stmt.Close()
+		}
+		tx.Rollback()
+		return 0, err
+	}
+	//
+	for line := 1; ; line++ {
+		//
+		record, err := cr.Read()
+		//
+		if nil != err {
+			if io.EOF == err {
+				break
+			}
+			return fail(err)
+		}
+		//
+		switch {
+		case 2 <= len(record) && csvTableMarker == record[0]:
+			//
+			if nil != table {
+				table.stmt.Close()
+				table = nil
+			}
+			//
+			pending = append(record[1:], "")
+		case nil != pending:
+			//
+			if table, err = sqliteLoadPrepare(tx, pending[0], pending[1], record); nil != err {
+				return fail(err)
+			}
+			//
+			pending = nil
+		case nil != table:
+			//
+			if len(record) != len(table.types) {
+				return fail(fmt.Errorf("record %d has %d values, expect %d", line, len(record), len(table.types)))
+			}
+			//
+			args := make([]interface{}, len(record))
+			//
+			for i, item := range record {
+				if value, err := sqliteCSVParse(item); nil == err {
+					args[i] = value
+				} else {
+					return fail(fmt.Errorf("record %d, %w", line, err))
+				}
+			}
+			//
+			if _, err := table.stmt.Exec(args...); nil == err {
+				cnt++
+			} else {
+				return fail(fmt.Errorf("record %d, %w", line, err))
+			}
+		default:
+			return fail(fmt.Errorf("record %d, missing %s record", line, csvTableMarker))
+		}
+	}
+	//
+	if nil != table {
+		table.stmt.Close()
+	}
+	//
+	return cnt, tx.Commit()
+}
+
+func sqliteCSVParse(value string) (interface{}, error) {
+	//
+	if csvNull == value {
+		return nil, nil
+	}
+	// 转义的文本
+	if strings.HasPrefix(value, csvEscape) {
+		return value[len(csvEscape):], nil
+	}
+	// 同形式的文本已转义，不论列的类型都是BLOB
+	if csvBlobRegexp.MatchString(value) {
+		return hex.DecodeString(value[2 : len(value)-1])
+	}
+	// 其余按文本写入，由列的类型亲和性转换
+	return value, nil
+}
+
+func sqliteLoadJSONL(db *sql.DB, r io.Reader) (int64, error) {
+	//
+	decoder := json.NewDecoder(r)
+	// 保留数字原样，按列类型转换
+	decoder.UseNumber()
+	//
+	tx, err := db.Begin()
+	//
+	if nil != err {
+		return 0, err
+	}
+	//
+	var cnt int64
+	var table *sqliteLoadTable
+	//
+	fail := func(err error) (int64, error) {
+		if nil != table {
+			table.stmt.Close()
+		}
+		tx.Rollback()
+		return 0, err
+	}
+	//
+	for i := 1; ; i++ {
+		//
+		var line sqliteDumpLine
+		//
+		if err := decoder.Decode(&line); nil != err {
+			if io.EOF == err {
+				break
+			}
+			return fail(fmt.Errorf("line %d, %w", i, err))
+		}
+		//
+		if 0 < len(line.Columns) {
+			//
+			if nil != table {
+				table.stmt.Close()
+				table = nil
+			}
+			//
+			if table, err = sqliteLoadPrepare(tx, line.Table, line.SQL, line.Columns); nil != err {
+				return fail(fmt.Errorf("line %d, %w", i, err))
+			}
+			//
+			continue
+		}
+		//
+		if nil == table || line.Table != table.name {
+			return fail(fmt.Errorf("line %d, table %s has no columns record", i, line.Table))
+		}
+		//
+		if len(line.Row) != len(table.types) {
+			return fail(fmt.Errorf("line %d has %d values, expect %d", i, len(line.Row), len(table.types)))
+		}
+		//
+		for j, _ := range line.Row {
+			// 导出的是保存的原值，时间不需要转换
+			if value, err := sqliteRawJSONValue(table.types[j], line.Row[j]); nil == err {
+				line.Row[j] = value
+			} else {
+				return fail(fmt.Errorf("line %d, %w", i, err))
+			}
+		}
+		//
+		if _, err := table.stmt.Exec(line.Row...); nil == err {
+			cnt++
+		} else {
+			return fail(fmt.Errorf("line %d, %w", i, err))
+		}
+	}
+	//
+	if nil != table {
+		table.stmt.Close()
+	}
+	//
+	return cnt, tx.Commit()
+}
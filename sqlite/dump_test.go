@@ -0,0 +1,166 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 导出后再导入，每个值的存储类型及内容不变，符合base64格式的文本仍为文本
+func TestDumpRawValues(t *testing.T) {
+	//
+	for _, format := range []int{DumpSQL, DumpCSV, DumpJSONL} {
+		//
+		db1 := NewSQLiteDB(WithName(fmt.Sprintf("%s_%d_1", t.Name(), format)))
+		//
+		conn1, err := db1.GetConn()
+		//
+		if nil != err {
+			t.Fatal(err)
+		}
+		//
+		if _, err := conn1.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, at DATETIME, flag BOOLEAN, data); INSERT INTO t VALUES (1, 'not a time', 5, X'000102'), (2, '2020-01-02T03:04:05Z', 1, 'AAEC');"); nil != err {
+			t.Fatal(err)
+		}
+		//
+		var buf bytes.Buffer
+		//
+		if err := db1.Dump(&buf, format); nil != err {
+			t.Fatal(err)
+		}
+		//
+		db1.Close()
+		//
+		db2 := NewSQLiteDB(WithName(fmt.Sprintf("%s_%d_2", t.Name(), format)))
+		//
+		conn2, err := db2.GetConn()
+		//
+		if nil != err {
+			t.Fatal(err)
+		}
+		//
+		if n, err := db2.Load(&buf); nil != err {
+			t.Fatal(err)
+		} else if 2 != n {
+			t.Fatalf("format %d loaded %d rows, expected 2", format, n)
+		}
+		//
+		var result string
+		//
+		if err := conn2.QueryRow("SELECT group_concat(quote(at) || typeof(flag) || flag || quote(data), ',') FROM t;").Scan(&result); nil != err {
+			t.Fatal(err)
+		} else if "'not a time'integer5X'000102','2020-01-02T03:04:05Z'integer1'AAEC'" != result {
+			t.Fatalf("format %d loaded %s", format, result)
+		}
+		//
+		db2.Close()
+	}
+}
+
+// CSV中与NULL、BLOB及表头标记相同的文本转义后原样导入，TEXT列中的BLOB仍为BLOB
+func TestDumpCSVEscape(t *testing.T) {
+	//
+	db1 := NewSQLiteDB(WithName(testName(t)))
+	//
+	conn1, err := db1.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer db1.Close()
+	//
+	if _, err := conn1.Exec(`CREATE TABLE t (id INTEGER PRIMARY KEY, s TEXT, b); INSERT INTO t VALUES (1, '\N', '#table'), (2, 'X''00''', '\x'), (3, X'0102', NULL);`); nil != err {
+		t.Fatal(err)
+	}
+	//
+	var buf bytes.Buffer
+	//
+	if err := db1.Dump(&buf, DumpCSV); nil != err {
+		t.Fatal(err)
+	}
+	//
+	db2 := NewSQLiteDB(WithName(testName(t)))
+	//
+	conn2, err := db2.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer db2.Close()
+	//
+	if _, err := db2.Load(&buf); nil != err {
+		t.Fatal(err)
+	}
+	//
+	var result string
+	//
+	if err := conn2.QueryRow("SELECT group_concat(quote(s) || quote(b), ',') FROM t;").Scan(&result); nil != err {
+		t.Fatal(err)
+	} else if `'\N''#table','X''00''''\x',X'0102'NULL` != result {
+		t.Fatalf("loaded %s", result)
+	}
+}
+
+type testBlockWriter struct {
+	ch   chan struct{}
+	once sync.Once
+}
+
+func (this *testBlockWriter) Write(p []byte) (int, error) {
+	this.once.Do(func() {
+		this.ch <- struct{}{}
+		<-this.ch
+	})
+	return len(p), nil
+}
+
+// 写入阻塞时不占用数据库连接
+func TestDumpSlowWriter(t *testing.T) {
+	//
+	db := NewSQLiteDB(WithName(testName(t)))
+	//
+	conn, err := db.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer db.Close()
+	//
+	if _, err := conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY); INSERT INTO t VALUES (1);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	w := &testBlockWriter{
+		ch: make(chan struct{}),
+	}
+	//
+	result := make(chan error, 1)
+	//
+	go func() {
+		result <- db.Dump(w, DumpSQL)
+	}()
+	//
+	<-w.ch
+	//
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	//
+	_, err = conn.ExecContext(ctx, "INSERT INTO t VALUES (2);")
+	//
+	cancel()
+	//
+	w.ch <- struct{}{}
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if err := <-result; nil != err {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,396 @@
+package sqlite
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elitah/utils/httptools"
+	"github.com/elitah/utils/logs"
+)
+
+const (
+	// 单次查询的超时时间
+	httpQueryTimeout = 5 * time.Second
+
+	// 分页的默认及最大行数
+	httpRowsLimit = 100
+	httpRowsMax   = 1000
+)
+
+type sqliteHttpTable struct {
+	Name string `json:"name"`
+	Rows int64  `json:"rows"`
+	SQL  string `json:"sql"`
+}
+
+type sqliteHttpColumn struct {
+	Name    string      `json:"name"`
+	Type    string      `json:"type"`
+	NotNull bool        `json:"notnull"`
+	Default interface{} `json:"default"`
+	PK      int         `json:"pk"`
+}
+
+type sqliteHttpSchema struct {
+	Table   string              `json:"table"`
+	SQL     string              `json:"sql"`
+	Columns []*sqliteHttpColumn `json:"columns"`
+	Indexes []string            `json:"indexes"`
+}
+
+type sqliteHttpRows struct {
+	Table     string          `json:"table,omitempty"`
+	Columns   []string        `json:"columns"`
+	Rows      [][]interface{} `json:"rows"`
+	Offset    int             `json:"offset"`
+	Limit     int             `json:"limit"`
+	Total     int64           `json:"total,omitempty"`
+	Truncated bool            `json:"truncated,omitempty"`
+}
+
+type sqliteHttpError struct {
+	Error string `json:"error"`
+}
+
+// 只读的数据库查看接口，返回JSON，路径相对于prefix：
+// /tables列出所有表及行数，/schema?table=t返回表结构及索引，
+// /rows?table=t&offset=0&limit=100分页查看表中的行，/query?sql=SELECT...&limit=100执行只读查询
+// 查询在独占的连接上以PRAGMA query_only执行，/query只接受单条只读的SELECT，auth返回false时拒绝请求，auth为nil时拒绝所有请求
+func (this *SQLiteDB) HttpHandler(prefix string, auth func(*http.Request) bool) http.Handler {
+	//
+	prefix = strings.TrimRight(prefix, "/")
+	//
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 获取通用处理器
+		if resp := httptools.NewHttpHandler(r); nil != resp {
+			// 释放
+			defer func() {
+				resp.Output(w)
+				resp.Release()
+			}()
+			//
+			if nil == auth || !auth(r) {
+				resp.SendHttpCode(http.StatusForbidden)
+				return
+			}
+			//
+			path := resp.GetPath()
+			//
+			if !strings.HasPrefix(path, prefix+"/") {
+				resp.NotFound()
+				return
+			}
+			//
+			var result interface{}
+			var err error
+			// 识别路径
+			switch path[len(prefix):] {
+			case "/tables":
+				if resp.HttpOnlyIs("GET") {
+					result, err = this.httpTables(r.Context())
+				}
+			case "/schema":
+				if resp.HttpOnlyIs("GET") {
+					if table := r.FormValue("table"); "" != table {
+						result, err = this.httpSchema(r.Context(), table)
+					} else {
+						resp.SendHttpCode(http.StatusBadRequest)
+					}
+				}
+			case "/rows":
+				if resp.HttpOnlyIs("GET") {
+					if table := r.FormValue("table"); "" != table {
+						result, err = this.httpRows(r.Context(), table, sqliteHttpInt(r, "offset", 0), sqliteHttpLimit(r))
+					} else {
+						resp.SendHttpCode(http.StatusBadRequest)
+					}
+				}
+			case "/query":
+				if resp.HttpOnlyIs("GET", "POST") {
+					if query := strings.TrimSpace(r.FormValue("sql")); "" != query {
+						result, err = this.httpQuery(r.Context(), query, sqliteHttpLimit(r))
+					} else {
+						resp.SendHttpCode(http.StatusBadRequest)
+					}
+				}
+			default:
+				resp.NotFound()
+			}
+			// 错误信息以JSON返回，便于排查
+			if nil != err {
+				result = &sqliteHttpError{
+					Error: err.Error(),
+				}
+			}
+			//
+			if nil != result {
+				if err := resp.SendJson(result); nil != err {
+					logs.Error(err)
+				}
+			}
+			//
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+}
+
+func sqliteHttpInt(r *http.Request, key string, value int) int {
+	if n, err := strconv.Atoi(r.FormValue(key)); nil == err && 0 <= n {
+		return n
+	}
+	return value
+}
+
+func sqliteHttpLimit(r *http.Request) int {
+	if n := sqliteHttpInt(r, "limit", httpRowsLimit); 0 < n && httpRowsMax >= n {
+		return n
+	}
+	return httpRowsMax
+}
+
+// 在独占连接上只读执行fn，防止查看接口修改数据
+func (this *SQLiteDB) httpReadOnly(ctx context.Context, fn func(context.Context, *sql.Conn) error) error {
+	//
+	db, err := this.GetConn(true)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	ctx, cancel := context.WithTimeout(ctx, httpQueryTimeout)
+	//
+	defer cancel()
+	//
+	conn, err := db.Conn(ctx)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	defer conn.Close()
+	//
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = 1;"); nil != err {
+		return err
+	}
+	// 连接归还前必须恢复，否则后续写入都会失败
+	defer conn.ExecContext(context.Background(), "PRAGMA query_only = 0;")
+	//
+	return fn(ctx, conn)
+}
+
+func (this *SQLiteDB) httpTables(ctx context.Context) (result []*sqliteHttpTable, err error) {
+	err = this.httpReadOnly(ctx, func(ctx context.Context, conn *sql.Conn) error {
+		//
+		if rows, err := conn.QueryContext(ctx, "SELECT name, sql FROM main.sqlite_master WHERE type='table' ORDER BY name;"); nil == err {
+			//
+			for rows.Next() {
+				//
+				item := &sqliteHttpTable{}
+				//
+				if err := rows.Scan(&item.Name, &item.SQL); nil != err {
+					rows.Close()
+					return err
+				}
+				//
+				result = append(result, item)
+			}
+			//
+			rows.Close()
+			//
+			if err := rows.Err(); nil != err {
+				return err
+			}
+		} else {
+			return err
+		}
+		//
+		for _, item := range result {
+			if err := conn.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM main.%s;", sqliteQuote(item.Name))).Scan(&item.Rows); nil != err {
+				return err
+			}
+		}
+		//
+		return nil
+	})
+	//
+	return
+}
+
+func (this *SQLiteDB) httpSchema(ctx context.Context, table string) (result *sqliteHttpSchema, err error) {
+	err = this.httpReadOnly(ctx, func(ctx context.Context, conn *sql.Conn) error {
+		//
+		result = &sqliteHttpSchema{
+			Table: table,
+		}
+		//
+		if err := conn.QueryRowContext(ctx, "SELECT sql FROM main.sqlite_master WHERE type='table' AND name=?;", table).Scan(&result.SQL); nil != err {
+			if sql.ErrNoRows == err {
+				return fmt.Errorf("table %s not found", table)
+			}
+			return err
+		}
+		//
+		if rows, err := conn.QueryContext(ctx, fmt.Sprintf("PRAGMA main.table_info(%s);", sqliteQuote(table))); nil == err {
+			//
+			for rows.Next() {
+				//
+				var cid int
+				//
+				item := &sqliteHttpColumn{}
+				//
+				if err := rows.Scan(&cid, &item.Name, &item.Type, &item.NotNull, &item.Default, &item.PK); nil != err {
+					rows.Close()
+					return err
+				}
+				// 驱动以[]byte返回文本
+				if b, ok := item.Default.([]byte); ok {
+					item.Default = string(b)
+				}
+				//
+				result.Columns = append(result.Columns, item)
+			}
+			//
+			rows.Close()
+			//
+			if err := rows.Err(); nil != err {
+				return err
+			}
+		} else {
+			return err
+		}
+		//
+		if rows, err := conn.QueryContext(ctx, "SELECT sql FROM main.sqlite_master WHERE type='index' AND tbl_name=? AND sql IS NOT NULL ORDER BY name;", table); nil == err {
+			//
+			defer rows.Close()
+			//
+			for rows.Next() {
+				//
+				var s string
+				//
+				if err := rows.Scan(&s); nil != err {
+					return err
+				}
+				//
+				result.Indexes = append(result.Indexes, s)
+			}
+			//
+			return rows.Err()
+		} else {
+			return err
+		}
+	})
+	//
+	return
+}
+
+func (this *SQLiteDB) httpRows(ctx context.Context, table string, offset, limit int) (result *sqliteHttpRows, err error) {
+	err = this.httpReadOnly(ctx, func(ctx context.Context, conn *sql.Conn) error {
+		//
+		var total int64
+		//
+		if err := conn.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM main.%s;", sqliteQuote(table))).Scan(&total); nil != err {
+			return err
+		}
+		//
+		if _result, err := sqliteHttpSelect(ctx, conn, fmt.Sprintf("SELECT * FROM main.%s LIMIT ? OFFSET ?;", sqliteQuote(table)), limit, limit, offset); nil == err {
+			//
+			result = _result
+			//
+			result.Table = table
+			result.Offset = offset
+			result.Total = total
+			//
+			return nil
+		} else {
+			return err
+		}
+	})
+	//
+	return
+}
+
+// 外部传入的SQL只能是单条语句，准备时由授权回调拒绝读取以外的操作
+// query_only不能阻止ATTACH及修改连接状态的PRAGMA，这些状态会留在所有人共用的连接上
+func (this *SQLiteDB) httpQuery(ctx context.Context, query string, limit int) (result *sqliteHttpRows, err error) {
+	//
+	var list []string
+	//
+	if err := sqliteScanStatements(bufio.NewReader(strings.NewReader(query)), func(s string) error {
+		list = append(list, s)
+		return nil
+	}); nil != err {
+		return nil, err
+	}
+	//
+	if 1 != len(list) {
+		return nil, fmt.Errorf("only a single statement is allowed")
+	}
+	//
+	err = this.httpReadOnly(ctx, func(ctx context.Context, conn *sql.Conn) error {
+		//
+		this.store.SetReadOnly(true)
+		//
+		defer this.store.SetReadOnly(false)
+		//
+		result, err = sqliteHttpSelect(ctx, conn, list[0], limit)
+		//
+		return err
+	})
+	//
+	return
+}
+
+// 执行查询，最多返回limit行
+func sqliteHttpSelect(ctx context.Context, conn *sql.Conn, query string, limit int, args ...interface{}) (*sqliteHttpRows, error) {
+	if rows, err := conn.QueryContext(ctx, query, args...); nil == err {
+		//
+		defer rows.Close()
+		//
+		types, err := rows.ColumnTypes()
+		//
+		if nil != err {
+			return nil, err
+		}
+		//
+		result := &sqliteHttpRows{
+			Columns: make([]string, len(types)),
+			Rows:    [][]interface{}{},
+			Limit:   limit,
+		}
+		//
+		for i, item := range types {
+			result.Columns[i] = item.Name()
+		}
+		//
+		for rows.Next() {
+			//
+			if limit <= len(result.Rows) {
+				result.Truncated = true
+				break
+			}
+			//
+			values := make([]interface{}, len(types))
+			//
+			for i, _ := range values {
+				values[i] = sqliteScanValue(types[i])
+			}
+			//
+			if err := rows.Scan(values...); nil != err {
+				return nil, err
+			}
+			//
+			result.Rows = append(result.Rows, values)
+		}
+		//
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
@@ -0,0 +1,85 @@
+package sqlite
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testHttpQuery(t *testing.T, h http.Handler, query string) map[string]interface{} {
+	//
+	w := httptest.NewRecorder()
+	//
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/db/query?sql="+url.QueryEscape(query), nil))
+	//
+	var result map[string]interface{}
+	//
+	if err := json.Unmarshal(w.Body.Bytes(), &result); nil != err {
+		t.Fatalf("%s, %v: %s", query, err, w.Body.String())
+	}
+	//
+	return result
+}
+
+// /query只执行单条只读的SELECT，不能修改数据或连接状态
+func TestHttpQueryReadOnly(t *testing.T) {
+	//
+	db := NewSQLiteDB(WithName(t.Name()))
+	//
+	defer db.Close()
+	//
+	conn, err := db.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn.Exec("CREATE TABLE t (v); INSERT INTO t VALUES (1), (2);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	h := db.HttpHandler("/db", func(*http.Request) bool {
+		return true
+	})
+	//
+	for _, query := range []string{
+		"ATTACH DATABASE ':memory:' AS x",
+		"PRAGMA query_only = 0",
+		"PRAGMA foreign_keys = ON",
+		"PRAGMA case_sensitive_like = 1",
+		"SELECT 1; DELETE FROM t",
+		"SELECT 1; SELECT 2",
+		"DELETE FROM t",
+		"SELECT __journal_row(18, 't', 1, 1)",
+	} {
+		if result := testHttpQuery(t, h, query); nil == result["error"] {
+			t.Fatalf("%s accepted: %v", query, result)
+		}
+	}
+	//
+	var cnt, fk int
+	//
+	if err := conn.QueryRow("SELECT COUNT(*) FROM t;").Scan(&cnt); nil != err {
+		t.Fatal(err)
+	} else if 2 != cnt {
+		t.Fatalf("table has %d rows", cnt)
+	}
+	//
+	if err := conn.QueryRow("PRAGMA foreign_keys;").Scan(&fk); nil != err {
+		t.Fatal(err)
+	} else if 0 != fk {
+		t.Fatal("foreign_keys changed")
+	}
+	//
+	if result := testHttpQuery(t, h, "WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM n WHERE 3 > i) SELECT COUNT(*) FROM t, n;"); nil != result["error"] {
+		t.Fatalf("select rejected: %v", result)
+	} else if rows, ok := result["rows"].([]interface{}); !ok || 1 != len(rows) {
+		t.Fatalf("unexpected result %v", result)
+	}
+	// 查询结束后恢复正常的写入
+	if _, err := conn.Exec("INSERT INTO t VALUES (3);"); nil != err {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,317 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/elitah/utils/logs"
+)
+
+const (
+	// 增量备份时备份文件的挂载名
+	incrementalSchema = "incremental"
+
+	// 单条语句中rowid的最大数量
+	incrementalBatch = 500
+)
+
+// 只将变化的行写入备份文件，启用加密或存在WITHOUT ROWID的表时仍使用全量备份
+func WithIncrementalBackup(flag bool) Option {
+	return func(opts *options) {
+		opts.backup_incremental = flag
+	}
+}
+
+// 尝试增量备份，返回false表示需要进行全量备份，rotated表示备份文件已经轮换，调用者需持有备份锁
+func (this *SQLiteDB) backupIncremental(ctx context.Context) (ok bool, rotated bool) {
+	// 加密的备份文件无法直接修改
+	if this.encrypted() {
+		return false, false
+	}
+	// 首次备份或者备份文件丢失时需要全量备份
+	if version := atomic.LoadInt64(&this.schema); 0 <= version {
+		if _, err := os.Stat(this.opts.backup_path); nil == err {
+			if db, err := this.GetConn(true); nil == err {
+				// 独占连接，保证取出变化记录与应用变化之间没有其他写入
+				if conn, err := db.Conn(ctx); nil == err {
+					//
+					defer conn.Close()
+					//
+					var current int64
+					//
+					if err := conn.QueryRowContext(ctx, "PRAGMA main.schema_version;").Scan(&current); nil == err {
+						// 表结构发生变化，需要全量备份
+						if current != version {
+							return false, false
+						}
+						//
+						changes := this.store.TakeChanges()
+						//
+						if 0 == len(changes) {
+							return true, false
+						}
+						// 已取消时不轮换，变化留到下次备份
+						if nil != ctx.Err() {
+							//
+							this.store.MergeChanges(changes)
+							//
+							return false, false
+						}
+						// 与全量备份相同保留backup_max代，当前备份文件复制后在原文件上修改
+						if err := this.rotateBackups(true); nil != err {
+							//
+							logs.Error("增量备份轮换失败, 转为全量备份: %v", err)
+							//
+							return false, false
+						}
+						//
+						rotated = true
+						//
+						if n, err := sqliteApplyChanges(ctx, conn, this.opts.backup_path, changes); nil == err {
+							// 增量备份同样需要检查完整性并更新校验文件
+							if err := sqliteIntegrityCheck(this.opts.backup_path); nil == err {
+								//
+								if err := sqliteWriteChecksum(this.opts.backup_path); nil != err {
+									logs.Error("unable write checksum, %v", err)
+								}
+								//
+								logs.Info("数据库增量备份完成, 变化行数: %d", n)
+								//
+								return true, true
+							} else {
+								logs.Error("增量备份校验失败, 转为全量备份: %v", err)
+							}
+						} else {
+							//
+							logs.Error("增量备份失败, 转为全量备份: %v", err)
+							//
+							this.store.MergeChanges(changes)
+						}
+					} else {
+						logs.Error(err)
+					}
+				} else {
+					logs.Error(err)
+				}
+			}
+		}
+	}
+	return false, rotated
+}
+
+// 全量备份前记录表结构版本，并清空变化记录
+func (this *SQLiteDB) resetIncremental() {
+	if this.opts.backup_incremental {
+		if db, err := this.GetConn(true); nil == err {
+			var version int64
+			//
+			if err := db.QueryRow("PRAGMA main.schema_version;").Scan(&version); nil == err {
+				//
+				this.store.TakeChanges()
+				// 更新钩子不会因WITHOUT ROWID的表触发，存在这样的表时总是全量备份
+				if list, err := sqliteWithoutRowidTables(db); nil == err {
+					if 0 < len(list) {
+						logs.Warn("表%s没有行号(WITHOUT ROWID)，使用全量备份", strings.Join(list, ", "))
+					} else {
+						//
+						atomic.StoreInt64(&this.schema, version)
+						//
+						return
+					}
+				} else {
+					logs.Error(err)
+				}
+			}
+		}
+		atomic.StoreInt64(&this.schema, -1)
+	}
+}
+
+func sqliteApplyChanges(ctx context.Context, conn *sql.Conn, path string, changes map[string]map[int64]int) (int, error) {
+	//
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("ATTACH DATABASE ? AS %s;", incrementalSchema), path); nil != err {
+		return 0, err
+	}
+	//
+	defer conn.ExecContext(ctx, fmt.Sprintf("DETACH DATABASE %s;", incrementalSchema))
+	//
+	tx, err := conn.BeginTx(ctx, nil)
+	//
+	if nil != err {
+		return 0, err
+	}
+	//
+	cnt := 0
+	//
+	for table, rows := range changes {
+		//
+		list, err := sqliteTableColumns(tx, "main", table)
+		//
+		if nil != err {
+			tx.Rollback()
+			return 0, err
+		}
+		//
+		if 0 == len(list) {
+			tx.Rollback()
+			return 0, fmt.Errorf("table %s not found", table)
+		}
+		//
+		columns := sqliteQuoteList(list)
+		//
+		rowids := make([]interface{}, 0, len(rows))
+		//
+		for rowid, _ := range rows {
+			rowids = append(rowids, rowid)
+		}
+		//
+		for i := 0; len(rowids) > i; i += incrementalBatch {
+			//
+			batch := rowids[i:]
+			//
+			if incrementalBatch < len(batch) {
+				batch = batch[:incrementalBatch]
+			}
+			//
+			where := fmt.Sprintf("rowid IN (?%s)", strings.Repeat(", ?", len(batch)-1))
+			// 回滚的事务同样会触发钩子，因此无论何种操作都先删除再从内存库复制
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+				"DELETE FROM %s.%s WHERE %s;",
+				incrementalSchema,
+				sqliteQuote(table),
+				where,
+			), batch...); nil != err {
+				tx.Rollback()
+				return 0, err
+			}
+			//
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+				"INSERT INTO %s.%s (rowid, %s) SELECT rowid, %s FROM main.%s WHERE %s;",
+				incrementalSchema,
+				sqliteQuote(table),
+				columns,
+				columns,
+				sqliteQuote(table),
+				where,
+			), batch...); nil != err {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+		//
+		cnt += len(rowids)
+	}
+	//
+	return cnt, tx.Commit()
+}
+
+// 返回主库中的用户表
+func sqliteMainTables(q sqliteQueryer) ([]string, error) {
+	var list []string
+	//
+	if rows, err := q.Query("SELECT name FROM main.sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%';"); nil == err {
+		//
+		defer rows.Close()
+		//
+		for rows.Next() {
+			//
+			var name string
+			//
+			if err := rows.Scan(&name); nil == err {
+				list = append(list, name)
+			} else {
+				return nil, err
+			}
+		}
+		//
+		return list, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// 返回没有行号的表
+func sqliteWithoutRowidTables(q sqliteQueryer) ([]string, error) {
+	//
+	tables, err := sqliteMainTables(q)
+	//
+	if nil != err {
+		return nil, err
+	}
+	//
+	var list []string
+	//
+	for _, table := range tables {
+		if rowid, err := sqliteHasRowid(q, table); nil != err {
+			return nil, err
+		} else if !rowid {
+			list = append(list, table)
+		}
+	}
+	//
+	return list, nil
+}
+
+// 复制文件，写入完成并同步后返回
+func sqliteCopyFile(src, dst string) error {
+	if r, err := os.Open(src); nil == err {
+		//
+		defer r.Close()
+		//
+		if w, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644); nil == err {
+			//
+			if _, err := io.Copy(w, r); nil != err {
+				w.Close()
+				os.Remove(dst)
+				return err
+			}
+			//
+			if err := w.Sync(); nil != err {
+				w.Close()
+				os.Remove(dst)
+				return err
+			}
+			//
+			return w.Close()
+		} else {
+			return err
+		}
+	} else {
+		return err
+	}
+}
+
+type sqliteQueryer interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}
+
+// 返回表的全部列名
+func sqliteTableColumns(q sqliteQueryer, schema, table string) ([]string, error) {
+	var list []string
+	//
+	if rows, err := q.Query(fmt.Sprintf("PRAGMA %s.table_info(%s);", schema, sqliteQuote(table))); nil == err {
+		//
+		defer rows.Close()
+		//
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		//
+		for rows.Next() {
+			if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); nil == err {
+				list = append(list, name)
+			} else {
+				return nil, err
+			}
+		}
+		//
+		return list, rows.Err()
+	} else {
+		return nil, err
+	}
+}
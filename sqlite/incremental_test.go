@@ -0,0 +1,144 @@
+package sqlite
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testBackupCount(t *testing.T, path, table string) int {
+	//
+	db, err := sql.Open("sqlite3", path)
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer db.Close()
+	//
+	var cnt int
+	//
+	if err := db.QueryRow("SELECT COUNT(*) FROM " + sqliteQuote(table) + ";").Scan(&cnt); nil != err {
+		t.Fatal(err)
+	}
+	//
+	return cnt
+}
+
+// 更新钩子不会因WITHOUT ROWID的表触发，增量备份必须转为全量备份
+func TestIncrementalWithoutRowid(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "incremental")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	backup := filepath.Join(dir, "test.db")
+	//
+	db := NewSQLiteDB(WithName(t.Name()), WithBackup(backup), WithIncrementalBackup(true))
+	//
+	defer db.Close()
+	//
+	conn, err := db.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn.Exec("CREATE TABLE w (k TEXT PRIMARY KEY, v TEXT) WITHOUT ROWID;"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := db.StartBackup(false); nil != err && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	//
+	if err := db.Backup(); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn.Exec("INSERT INTO t (v) VALUES ('a');"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn.Exec("INSERT INTO w (k, v) VALUES ('a', 'b');"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if err := db.Backup(); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if n := testBackupCount(t, backup, "w"); 1 != n {
+		t.Fatalf("%d rows of WITHOUT ROWID table in backup, expected 1", n)
+	}
+	//
+	if n := testBackupCount(t, backup, "t"); 1 != n {
+		t.Fatalf("%d rows in backup, expected 1", n)
+	}
+}
+
+// 增量备份同样按backup_max保留旧的备份
+func TestIncrementalRotation(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "incremental")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	backup := filepath.Join(dir, "test.db")
+	//
+	db := NewSQLiteDB(WithName(t.Name()), WithBackup(backup, 2), WithIncrementalBackup(true))
+	//
+	defer db.Close()
+	//
+	conn, err := db.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := db.StartBackup(false); nil != err && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	//
+	for i := 0; 3 > i; i++ {
+		//
+		if _, err := conn.Exec("INSERT INTO t (v) VALUES ('a');"); nil != err {
+			t.Fatal(err)
+		}
+		//
+		if err := db.Backup(); nil != err {
+			t.Fatal(err)
+		}
+	}
+	//
+	for i, item := range []string{"test.db", "test.000.db", "test.001.db"} {
+		//
+		path := filepath.Join(dir, item)
+		//
+		if n := testBackupCount(t, path, "t"); 3-i != n {
+			t.Fatalf("%d rows in %s, expected %d", n, item, 3-i)
+		}
+		//
+		if err := sqliteVerifyChecksum(path); nil != err {
+			t.Fatalf("%s: %v", item, err)
+		}
+	}
+}
@@ -0,0 +1,831 @@
+package sqlite
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elitah/utils/logs"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// 日志记录头: 4字节长度 + 4字节CRC32
+	journalHeaderSize = 8
+
+	// 单条日志记录的最大长度
+	journalRecordMax = 64 * 1024 * 1024
+
+	// 日志触发器调用的函数及触发器名称前缀
+	journalFunc    = "__journal_row"
+	journalTrigger = "__journal_"
+)
+
+var (
+	EJournalCorrupt = errors.New("journal record corrupt")
+)
+
+func WithJournal(path string) Option {
+	return func(opts *options) {
+		opts.journal_path = path
+	}
+}
+
+type sqliteJournalRecord struct {
+	Op      int           `json:"op"`
+	Table   string        `json:"table"`
+	RowID   int64         `json:"rowid"`
+	Columns []string      `json:"columns,omitempty"`
+	Values  []sqliteValue `json:"values,omitempty"`
+}
+
+// 日志及复制记录中的值，只能是NULL、整数、实数、文本或BLOB，回放时作为参数绑定
+// JSON中NULL为null，整数为数值，文本为字符串，实数及BLOB为{"real":"1.5"}及{"blob":"base64"}
+type sqliteValue struct {
+	value interface{}
+}
+
+func newSQLiteValue(value interface{}) (sqliteValue, error) {
+	switch v := value.(type) {
+	case nil, int64, float64, string:
+		return sqliteValue{v}, nil
+	case []byte:
+		return sqliteValue{v}, nil
+	case bool:
+		if v {
+			return sqliteValue{int64(1)}, nil
+		}
+		return sqliteValue{int64(0)}, nil
+	case int:
+		return sqliteValue{int64(v)}, nil
+	}
+	//
+	return sqliteValue{}, fmt.Errorf("unsupported value type %T", value)
+}
+
+func (this sqliteValue) MarshalJSON() ([]byte, error) {
+	switch v := this.value.(type) {
+	case nil:
+		return []byte("null"), nil
+	case int64:
+		return []byte(strconv.FormatInt(v, 10)), nil
+	case float64:
+		return json.Marshal(map[string]string{"real": strconv.FormatFloat(v, 'g', -1, 64)})
+	case string:
+		return json.Marshal(v)
+	case []byte:
+		return json.Marshal(map[string]string{"blob": base64.StdEncoding.EncodeToString(v)})
+	}
+	//
+	return nil, fmt.Errorf("unsupported value type %T", this.value)
+}
+
+// 不是上述格式的值一律拒绝
+func (this *sqliteValue) UnmarshalJSON(data []byte) error {
+	//
+	data = bytes.TrimSpace(data)
+	//
+	if 0 == len(data) {
+		return EJournalCorrupt
+	}
+	//
+	switch data[0] {
+	case 'n':
+		if "null" == string(data) {
+			this.value = nil
+			return nil
+		}
+	case '"':
+		//
+		var s string
+		//
+		if err := json.Unmarshal(data, &s); nil == err {
+			this.value = s
+			return nil
+		}
+	case '{':
+		//
+		var m map[string]string
+		//
+		if err := json.Unmarshal(data, &m); nil == err && 1 == len(m) {
+			if s, ok := m["real"]; ok {
+				if f, err := strconv.ParseFloat(s, 64); nil == err {
+					this.value = f
+					return nil
+				}
+			} else if s, ok := m["blob"]; ok {
+				if b, err := base64.StdEncoding.DecodeString(s); nil == err {
+					this.value = b
+					return nil
+				}
+			}
+		}
+	default:
+		if n, err := strconv.ParseInt(string(data), 10, 64); nil == err {
+			this.value = n
+			return nil
+		}
+	}
+	//
+	return fmt.Errorf("%w, invalid value %.32s", EJournalCorrupt, data)
+}
+
+type sqliteJournal struct {
+	sync.Mutex
+
+	path string
+
+	file *os.File
+	// 最后一条完整记录的结束位置，写入失败时截断到该位置
+	size int64
+
+	db *sql.DB
+
+	// 启用加密时对记录内容加密
+	seal func([]byte) ([]byte, error)
+
+	// 表结构变化后重新安装日志触发器
+	install func(*sql.DB) error
+
+	queue []sqliteChange
+
+	notify  chan struct{}
+	refresh chan struct{}
+	closed  chan struct{}
+
+	wg sync.WaitGroup
+}
+
+func openJournal(path string, db *sql.DB, seal func([]byte) ([]byte, error), install func(*sql.DB) error) (*sqliteJournal, error) {
+	if f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); nil == err {
+		//
+		info, err := f.Stat()
+		//
+		if nil != err {
+			f.Close()
+			return nil, err
+		}
+		//
+		j := &sqliteJournal{
+			path:    path,
+			file:    f,
+			size:    info.Size(),
+			db:      db,
+			seal:    seal,
+			install: install,
+			notify:  make(chan struct{}, 1),
+			refresh: make(chan struct{}, 1),
+			closed:  make(chan struct{}),
+		}
+		//
+		j.wg.Add(1)
+		//
+		go j.loop()
+		//
+		return j, nil
+	} else {
+		return nil, err
+	}
+}
+
+// 由提交钩子调用，记录同步写入磁盘后返回
+func (this *sqliteJournal) Append(records []*sqliteJournalRecord) error {
+	if buf, err := this.encode(records); nil == err {
+		return this.write(buf)
+	} else {
+		return err
+	}
+}
+
+func (this *sqliteJournal) encode(records []*sqliteJournalRecord) ([]byte, error) {
+	var buf []byte
+	//
+	for _, record := range records {
+		if data, err := json.Marshal(record); nil == err {
+			//
+			if nil != this.seal {
+				if data, err = this.seal(data); nil != err {
+					return nil, err
+				}
+			}
+			//
+			buf = sqliteJournalAppend(buf, data)
+		} else {
+			return nil, err
+		}
+	}
+	//
+	return buf, nil
+}
+
+// 写入失败时截断不完整的记录，否则之后的记录在回放时会被当作损坏丢弃
+func (this *sqliteJournal) write(buf []byte) error {
+	this.Lock()
+	defer this.Unlock()
+	//
+	if nil == this.file {
+		return fmt.Errorf("journal was closed")
+	}
+	//
+	if _, err := this.file.Write(buf); nil == err {
+		if err := this.file.Sync(); nil == err {
+			//
+			this.size += int64(len(buf))
+			//
+			return nil
+		} else {
+			this.file.Truncate(this.size)
+			return err
+		}
+	} else {
+		this.file.Truncate(this.size)
+		return err
+	}
+}
+
+// 由提交钩子调用，不能阻塞
+func (this *sqliteJournal) Refresh() {
+	select {
+	case this.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// 由提交钩子调用，不能阻塞
+func (this *sqliteJournal) Push(list []sqliteChange) {
+	//
+	this.Lock()
+	//
+	this.queue = append(this.queue, list...)
+	//
+	this.Unlock()
+	//
+	select {
+	case this.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 切换到新的日志文件，旧日志保留到备份成功为止
+func (this *sqliteJournal) Rotate() error {
+	this.Lock()
+	defer this.Unlock()
+	//
+	if nil == this.file {
+		return fmt.Errorf("journal was closed")
+	}
+	//
+	this.file.Close()
+	//
+	old := this.path + ".old"
+	// 上次备份失败时旧日志仍然存在，需要合并
+	if _, err := os.Stat(old); nil == err {
+		if err := sqliteAppendFile(old, this.path); nil != err {
+			return err
+		}
+		os.Remove(this.path)
+	} else {
+		os.Rename(this.path, old)
+	}
+	//
+	if f, err := os.OpenFile(this.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); nil == err {
+		this.file = f
+		this.size = 0
+		return nil
+	} else {
+		this.file = nil
+		return err
+	}
+}
+
+// 备份成功后删除旧日志
+func (this *sqliteJournal) Compact() {
+	os.Remove(this.path + ".old")
+}
+
+func (this *sqliteJournal) Close() {
+	//
+	close(this.closed)
+	//
+	this.wg.Wait()
+	//
+	this.Lock()
+	//
+	if nil != this.file {
+		this.file.Close()
+		this.file = nil
+	}
+	//
+	this.Unlock()
+}
+
+func (this *sqliteJournal) loop() {
+	//
+	defer this.wg.Done()
+	//
+	for {
+		select {
+		case <-this.notify:
+			this.flush()
+		case <-this.refresh:
+			if nil != this.install {
+				if err := this.install(this.db); nil != err {
+					logs.Error(fmt.Errorf("unable install journal triggers, %w", err))
+				}
+			}
+		case <-this.closed:
+			this.flush()
+			return
+		}
+	}
+}
+
+func (this *sqliteJournal) flush() {
+	//
+	this.Lock()
+	//
+	list := this.queue
+	//
+	this.queue = nil
+	//
+	this.Unlock()
+	//
+	if 0 == len(list) {
+		return
+	}
+	// 在事务中读取并写入，期间其它事务无法提交，不会覆盖之后同步写入的记录
+	tx, err := this.db.Begin()
+	//
+	if nil != err {
+		logs.Error(err)
+		return
+	}
+	//
+	defer tx.Rollback()
+	//
+	if buf, err := this.encode(sqliteEncodeChanges(tx, list)); nil == err {
+		if err := this.write(buf); nil != err {
+			logs.Error(err)
+		}
+	} else {
+		logs.Error(err)
+	}
+}
+
+// 合并同一行的变化并读取行内容，行已不存在时记为删除
+func sqliteEncodeChanges(db sqliteQueryer, list []sqliteChange) []*sqliteJournalRecord {
+	// 同一行只需记录最终状态
+	index := make(map[string]map[int64]int)
+	//
+	changes := make([]sqliteChange, 0, len(list))
+	//
+	for _, item := range list {
+		if rows, ok := index[item.table]; ok {
+			if i, ok := rows[item.rowid]; ok {
+				changes[i].op = item.op
+				continue
+			}
+		} else {
+			index[item.table] = make(map[int64]int)
+		}
+		index[item.table][item.rowid] = len(changes)
+		changes = append(changes, item)
+	}
+	//
+	columns := make(map[string][]string)
+	//
+	var result []*sqliteJournalRecord
+	//
+	for _, item := range changes {
+		//
+		record := &sqliteJournalRecord{
+			Op:    item.op,
+			Table: item.table,
+			RowID: item.rowid,
+		}
+		//
+		if sqlite3.SQLITE_DELETE != item.op {
+			//
+			list, ok := columns[item.table]
+			//
+			if !ok {
+				if _list, err := sqliteTableColumns(db, "main", item.table); nil == err {
+					list = _list
+					columns[item.table] = list
+				} else {
+					logs.Error(err)
+					continue
+				}
+			}
+			//
+			if values, err := sqliteReadRow(db, item.table, list, item.rowid); nil == err {
+				if nil != values {
+					record.Columns = list
+					record.Values = values
+				} else {
+					// 行已不存在(被回滚或随后删除)
+					record.Op = sqlite3.SQLITE_DELETE
+				}
+			} else {
+				logs.Error(err)
+				continue
+			}
+		}
+		//
+		result = append(result, record)
+	}
+	//
+	return result
+}
+
+// 读取一行保存的原值，列名前加+使驱动得不到声明类型，不会转换时间或布尔值
+func sqliteReadRow(q sqliteQueryer, table string, columns []string, rowid int64) ([]sqliteValue, error) {
+	var sb strings.Builder
+	//
+	for i, name := range columns {
+		if 0 < i {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "+%s", sqliteQuote(name))
+	}
+	//
+	if rows, err := q.Query(fmt.Sprintf("SELECT %s FROM main.%s WHERE rowid=?;", sb.String(), sqliteQuote(table)), rowid); nil == err {
+		//
+		defer rows.Close()
+		//
+		if rows.Next() {
+			//
+			values := make([]interface{}, len(columns))
+			args := make([]interface{}, len(columns))
+			//
+			for i, _ := range values {
+				args[i] = &values[i]
+			}
+			//
+			if err := rows.Scan(args...); nil != err {
+				return nil, err
+			}
+			//
+			result := make([]sqliteValue, len(values))
+			//
+			for i, v := range values {
+				if _v, err := newSQLiteValue(v); nil == err {
+					result[i] = _v
+				} else {
+					return nil, err
+				}
+			}
+			//
+			return result, nil
+		}
+		//
+		return nil, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+func sqliteJournalAppend(buf, data []byte) []byte {
+	var header [journalHeaderSize]byte
+	//
+	binary.BigEndian.PutUint32(header[0:], uint32(len(data)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(data))
+	//
+	return append(append(buf, header[:]...), data...)
+}
+
+// 读取一条带长度及CRC32的记录，结尾时返回io.EOF，不完整或校验失败时返回EJournalCorrupt
+func sqliteReadFrame(r io.Reader) ([]byte, error) {
+	var header [journalHeaderSize]byte
+	//
+	if _, err := io.ReadFull(r, header[:]); nil != err {
+		if io.EOF == err {
+			return nil, io.EOF
+		}
+		return nil, EJournalCorrupt
+	}
+	//
+	n := binary.BigEndian.Uint32(header[0:])
+	//
+	if journalRecordMax < n {
+		return nil, EJournalCorrupt
+	}
+	//
+	data := make([]byte, n)
+	//
+	if _, err := io.ReadFull(r, data); nil != err {
+		return nil, EJournalCorrupt
+	}
+	//
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, EJournalCorrupt
+	}
+	//
+	return data, nil
+}
+
+// 读取日志记录，返回最后一条完整记录的结束位置，unseal不为空时先解密记录
+func sqliteJournalRead(r io.Reader, unseal func([]byte) ([]byte, error), fn func(*sqliteJournalRecord) error) (int64, error) {
+	var offset int64
+	//
+	br := bufio.NewReader(r)
+	//
+	for {
+		//
+		data, err := sqliteReadFrame(br)
+		//
+		if nil != err {
+			if io.EOF == err {
+				return offset, nil
+			}
+			return offset, err
+		}
+		//
+		n := len(data)
+		// 校验通过但无法解密，说明密钥错误而不是写入不完整
+		if nil != unseal {
+			if _data, err := unseal(data); nil == err {
+				data = _data
+			} else {
+				return offset, err
+			}
+		}
+		//
+		var record sqliteJournalRecord
+		//
+		if err := json.Unmarshal(data, &record); nil != err {
+			return offset, EJournalCorrupt
+		}
+		//
+		if err := fn(&record); nil != err {
+			return offset, err
+		}
+		//
+		offset += int64(journalHeaderSize + n)
+	}
+}
+
+// 回放日志到内存数据库，表结构变化不记录在日志中，不存在的表跳过并报告，已删除的列忽略
+func sqliteReplayJournal(db *sql.DB, path string, unseal func([]byte) ([]byte, error)) (int64, error) {
+	var cnt int64
+	//
+	tx, err := db.Begin()
+	//
+	if nil != err {
+		return 0, err
+	}
+	//
+	columns := make(map[string]map[string]bool)
+	//
+	skipped := make(map[string]int)
+	//
+	apply := func(record *sqliteJournalRecord) error {
+		//
+		live, ok := columns[record.Table]
+		//
+		if !ok {
+			if list, err := sqliteTableColumns(tx, "main", record.Table); nil == err {
+				//
+				if 0 < len(list) {
+					live = make(map[string]bool, len(list))
+					for _, name := range list {
+						live[name] = true
+					}
+				}
+				//
+				columns[record.Table] = live
+			} else {
+				return err
+			}
+		}
+		//
+		if nil == live {
+			skipped[record.Table]++
+			return nil
+		}
+		//
+		if err := sqliteApplyRecord(tx, sqliteFilterRecord(record, live)); nil != err {
+			return err
+		}
+		//
+		cnt++
+		//
+		return nil
+	}
+	//
+	for _, item := range []string{path + ".old", path} {
+		if f, err := os.Open(item); nil == err {
+			//
+			offset, err := sqliteJournalRead(f, unseal, apply)
+			//
+			f.Close()
+			//
+			if nil != err {
+				if EJournalCorrupt == err {
+					// 尾部写入不完整，截断后继续
+					logs.Warn("日志文件%s在%d处损坏，已跳过剩余内容", item, offset)
+					//
+					os.Truncate(item, offset)
+				} else {
+					tx.Rollback()
+					return 0, err
+				}
+			}
+		} else if !os.IsNotExist(err) {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	//
+	if err := tx.Commit(); nil != err {
+		return 0, err
+	}
+	//
+	for table, n := range skipped {
+		logs.Warn("日志中的表%s不存在，已跳过%d条记录", table, n)
+	}
+	//
+	return cnt, nil
+}
+
+// 只保留当前表中存在的列
+func sqliteFilterRecord(record *sqliteJournalRecord, live map[string]bool) *sqliteJournalRecord {
+	//
+	if len(record.Columns) != len(record.Values) {
+		return record
+	}
+	//
+	result := *record
+	//
+	result.Columns, result.Values = nil, nil
+	//
+	for i, name := range record.Columns {
+		if live[name] {
+			result.Columns = append(result.Columns, name)
+			result.Values = append(result.Values, record.Values[i])
+		}
+	}
+	//
+	return &result
+}
+
+// 为所有有行号的表安装临时触发器，行内容在语句执行时传给journalFunc，提交前同步写入日志
+func (this *SQLiteDB) installJournalTriggers(db *sql.DB) error {
+	// 事务占用唯一的连接，安装期间不会有其它变化
+	tx, err := db.Begin()
+	//
+	if nil != err {
+		return err
+	}
+	//
+	defer tx.Rollback()
+	//
+	tables, err := sqliteMainTables(tx)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	triggers := make(map[string][]string, len(tables))
+	//
+	for _, table := range tables {
+		//
+		if rowid, err := sqliteHasRowid(tx, table); nil != err {
+			return err
+		} else if !rowid {
+			logs.Warn("表%s没有行号(WITHOUT ROWID)，其变化不会记录到日志", table)
+			continue
+		}
+		//
+		columns, err := sqliteTableColumns(tx, "main", table)
+		//
+		if nil != err {
+			return err
+		}
+		//
+		var values strings.Builder
+		//
+		for _, name := range columns {
+			fmt.Fprintf(&values, ", NEW.%s", sqliteQuote(name))
+		}
+		//
+		for _, item := range []struct {
+			event string
+			args  string
+		}{
+			{"INSERT", fmt.Sprintf("%d, %s, NEW.rowid, NEW.rowid%s", sqlite3.SQLITE_INSERT, sqliteQuoteString(table), values.String())},
+			{"UPDATE", fmt.Sprintf("%d, %s, OLD.rowid, NEW.rowid%s", sqlite3.SQLITE_UPDATE, sqliteQuoteString(table), values.String())},
+			{"DELETE", fmt.Sprintf("%d, %s, OLD.rowid, OLD.rowid", sqlite3.SQLITE_DELETE, sqliteQuoteString(table))},
+		} {
+			//
+			name := sqliteQuote(journalTrigger + strings.ToLower(item.event) + "_" + table)
+			//
+			if _, err := tx.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS temp.%s;", name)); nil != err {
+				return err
+			}
+			//
+			if _, err := tx.Exec(fmt.Sprintf(
+				"CREATE TEMP TRIGGER %s AFTER %s ON main.%s BEGIN SELECT %s(%s); END;",
+				name,
+				item.event,
+				sqliteQuote(table),
+				journalFunc,
+				item.args,
+			)); nil != err {
+				return err
+			}
+		}
+		//
+		triggers[table] = columns
+	}
+	// 在提交前设置，提交后的变化都由触发器记录
+	this.store.SetTriggers(triggers)
+	//
+	return tx.Commit()
+}
+
+// WITHOUT ROWID的表没有行号，更新钩子及按行号的回放均不适用
+func sqliteHasRowid(q sqliteQueryer, table string) (bool, error) {
+	if rows, err := q.Query(fmt.Sprintf("SELECT rowid FROM main.%s LIMIT 0;", sqliteQuote(table))); nil == err {
+		rows.Close()
+		return true, nil
+	} else if strings.Contains(err.Error(), "no such column") {
+		return false, nil
+	} else {
+		return false, err
+	}
+}
+
+// 以先删除再插入的方式应用一条记录，重复应用结果不变，值作为参数绑定
+func sqliteApplyRecord(tx *sql.Tx, record *sqliteJournalRecord) error {
+	//
+	switch record.Op {
+	case sqlite3.SQLITE_INSERT, sqlite3.SQLITE_UPDATE, sqlite3.SQLITE_DELETE:
+	default:
+		return fmt.Errorf("%w, unknown operation %d", EJournalCorrupt, record.Op)
+	}
+	//
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM main.%s WHERE rowid=?;", sqliteQuote(record.Table)), record.RowID); nil != err {
+		return err
+	}
+	//
+	if sqlite3.SQLITE_DELETE != record.Op && 0 < len(record.Columns) {
+		//
+		if len(record.Columns) != len(record.Values) {
+			return EJournalCorrupt
+		}
+		//
+		args := make([]interface{}, 0, 1+len(record.Values))
+		//
+		args = append(args, record.RowID)
+		//
+		for _, item := range record.Values {
+			args = append(args, item.value)
+		}
+		//
+		if _, err := tx.Exec(fmt.Sprintf(
+			"INSERT INTO main.%s (rowid, %s) VALUES (?%s);",
+			sqliteQuote(record.Table),
+			sqliteQuoteList(record.Columns),
+			strings.Repeat(", ?", len(record.Values)),
+		), args...); nil != err {
+			return err
+		}
+	}
+	//
+	return nil
+}
+
+func sqliteAppendFile(dst, src string) error {
+	if r, err := os.Open(src); nil == err {
+		//
+		defer r.Close()
+		//
+		if w, err := os.OpenFile(dst, os.O_APPEND|os.O_WRONLY, 0644); nil == err {
+			//
+			defer w.Close()
+			//
+			if _, err := io.Copy(w, r); nil == err {
+				return w.Sync()
+			} else {
+				return err
+			}
+		} else {
+			return err
+		}
+	} else {
+		return err
+	}
+}
@@ -0,0 +1,271 @@
+package sqlite
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testJournalRecords(t *testing.T, path string) []*sqliteJournalRecord {
+	//
+	f, err := os.Open(path)
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer f.Close()
+	//
+	var list []*sqliteJournalRecord
+	//
+	if _, err := sqliteJournalRead(f, nil, func(record *sqliteJournalRecord) error {
+		list = append(list, record)
+		return nil
+	}); nil != err {
+		t.Fatal(err)
+	}
+	//
+	return list
+}
+
+// 提交返回时记录必须已在日志文件中，进程随后崩溃也能由新实例回放
+func TestJournalCrashReplay(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "journal")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	backup := filepath.Join(dir, "test.db")
+	journal := filepath.Join(dir, "test.journal")
+	//
+	db1 := NewSQLiteDB(WithName(testName(t)), WithBackup(backup), WithJournal(journal))
+	//
+	conn1, err := db1.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn1.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT, score REAL, data BLOB);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := db1.StartBackup(false); nil != err {
+		t.Fatal(err)
+	}
+	// 表结构在备份中，之后的变化只在日志中
+	if err := db1.Backup(); nil != err {
+		t.Fatal(err)
+	}
+	//
+	for i := 0; 100 > i; i++ {
+		if _, err := conn1.Exec("INSERT INTO t (name, score, data) VALUES (?, ?, ?);", fmt.Sprintf("name-%d", i), float64(i), []byte{byte(i)}); nil != err {
+			t.Fatal(err)
+		}
+	}
+	//
+	if _, err := conn1.Exec("UPDATE t SET score=0.5 WHERE id=1;"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn1.Exec("DELETE FROM t WHERE id=2;"); nil != err {
+		t.Fatal(err)
+	}
+	// 不关闭db1，模拟进程崩溃，日志中必须已有全部变化
+	if list := testJournalRecords(t, journal); 102 != len(list) {
+		t.Fatalf("journal has %d records, expected 102", len(list))
+	}
+	//
+	db2 := NewSQLiteDB(WithName(testName(t)), WithBackup(backup), WithJournal(journal))
+	//
+	defer db2.Close()
+	//
+	conn2, err := db2.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	// 与正常启动相同，先建表再恢复
+	if _, err := conn2.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT, score REAL, data BLOB);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if n, err := db2.StartBackup(false); nil != err {
+		t.Fatal(err)
+	} else if 102 != n {
+		t.Fatalf("replayed %d records, expected 102", n)
+	}
+	//
+	var cnt int
+	//
+	if err := conn2.QueryRow("SELECT COUNT(*) FROM t;").Scan(&cnt); nil != err {
+		t.Fatal(err)
+	} else if 99 != cnt {
+		t.Fatalf("%d rows restored, expected 99", cnt)
+	}
+	//
+	var kind string
+	var score float64
+	var data []byte
+	//
+	if err := conn2.QueryRow("SELECT typeof(score), score FROM t WHERE id=1;").Scan(&kind, &score); nil != err {
+		t.Fatal(err)
+	} else if "real" != kind || 0.5 != score {
+		t.Fatalf("unexpected score %s %v", kind, score)
+	}
+	//
+	if err := conn2.QueryRow("SELECT typeof(score), data FROM t WHERE id=11;").Scan(&kind, &data); nil != err {
+		t.Fatal(err)
+	} else if "real" != kind || 1 != len(data) || 10 != data[0] {
+		t.Fatalf("unexpected row %s %v", kind, data)
+	}
+}
+
+// 表结构变化不在日志中，回放时跳过不存在的表及列
+func TestJournalReplayUnknownTable(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "journal")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	journal := filepath.Join(dir, "test.journal")
+	//
+	var buf []byte
+	//
+	for _, item := range []string{
+		`{"op":18,"table":"missing","rowid":1,"columns":["a"],"values":[1]}`,
+		`{"op":18,"table":"t","rowid":1,"columns":["a","dropped"],"values":["x",2]}`,
+	} {
+		buf = sqliteJournalAppend(buf, []byte(item))
+	}
+	//
+	if err := ioutil.WriteFile(journal, buf, 0644); nil != err {
+		t.Fatal(err)
+	}
+	//
+	db := NewSQLiteDB(WithName(t.Name()))
+	//
+	defer db.Close()
+	//
+	conn, err := db.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn.Exec("CREATE TABLE t (a TEXT);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if n, err := sqliteReplayJournal(conn, journal, nil); nil != err {
+		t.Fatal(err)
+	} else if 1 != n {
+		t.Fatalf("replayed %d records, expected 1", n)
+	}
+	//
+	var a string
+	//
+	if err := conn.QueryRow("SELECT a FROM t WHERE rowid=1;").Scan(&a); nil != err {
+		t.Fatal(err)
+	} else if "x" != a {
+		t.Fatalf("unexpected value %q", a)
+	}
+}
+
+// 日志中的值作为参数绑定，修改过的日志不能执行SQL，非标量的值被拒绝
+func TestJournalTamperedRecord(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "journal")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	journal := filepath.Join(dir, "test.journal")
+	//
+	db := NewSQLiteDB(WithName(t.Name()))
+	//
+	defer db.Close()
+	//
+	conn, err := db.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn.Exec("CREATE TABLE t (a, b);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	for _, item := range []struct {
+		record string
+		ok     bool
+	}{
+		{`{"op":18,"table":"t","rowid":1,"columns":["a","b"],"values":["1); DROP TABLE t; --",{"real":"1.5"}]}`, true},
+		{`{"op":18,"table":"t","rowid":2,"columns":["a","b"],"values":[{"blob":"AAE="},null]}`, true},
+		{`{"op":18,"table":"t","rowid":3,"columns":["a","b"],"values":[1,[2]]}`, false},
+		{`{"op":18,"table":"t","rowid":3,"columns":["a","b"],"values":[1,{"sql":"1"}]}`, false},
+		{`{"op":18,"table":"t","rowid":3,"columns":["a","b"],"values":[1,1.5]}`, false},
+		{`{"op":99,"table":"t","rowid":3}`, false},
+	} {
+		//
+		if err := ioutil.WriteFile(journal, sqliteJournalAppend(nil, []byte(item.record)), 0644); nil != err {
+			t.Fatal(err)
+		}
+		//
+		if n, err := sqliteReplayJournal(conn, journal, nil); nil != err {
+			if item.ok {
+				t.Fatalf("%s, %v", item.record, err)
+			}
+		} else if item.ok != (1 == n) {
+			t.Fatalf("%s replayed %d records", item.record, n)
+		}
+	}
+	//
+	var result string
+	//
+	if err := conn.QueryRow("SELECT group_concat(quote(a) || typeof(b), ',') FROM t;").Scan(&result); nil != err {
+		t.Fatal(err)
+	} else if "'1); DROP TABLE t; --'real,X'0001'null" != result {
+		t.Fatalf("unexpected rows %s", result)
+	}
+}
+
+// 启用加密后，第一条加密记录之后的明文记录被拒绝
+func TestJournalPlaintextAfterSealed(t *testing.T) {
+	//
+	db := NewSQLiteDB(WithName(t.Name()), WithEncryption("0123456789abcdef"))
+	//
+	sealed, err := db.seal([]byte(`{"op":18,"table":"t","rowid":1}`))
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	plain := []byte(`{"op":9,"table":"t","rowid":1}`)
+	// 启用加密前写入的明文记录可以回放
+	unseal := db.journalUnseal()
+	//
+	for _, data := range [][]byte{plain, sealed} {
+		if _, err := unseal(data); nil != err {
+			t.Fatal(err)
+		}
+	}
+	//
+	if _, err := unseal(plain); !errors.Is(err, EJournalCorrupt) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/elitah/utils/logs"
+)
+
+type sqliteMigration struct {
+	version int
+
+	up   func(*sql.Tx) error
+	down func(*sql.Tx) error
+}
+
+// 注册版本迁移，版本号从1开始，StartBackup恢复数据前会将备份文件迁移到最高版本
+// 迁移完成后的建表语句应与CreateTable创建的一致，否则数据仍无法同步
+func (this *SQLiteDB) RegisterMigration(version int, up, down func(*sql.Tx) error) error {
+	if 0 < version && nil != up {
+		//
+		this.Lock()
+		defer this.Unlock()
+		//
+		for _, item := range this.migrations {
+			if version == item.version {
+				return fmt.Errorf("migration %d already registered", version)
+			}
+		}
+		//
+		this.migrations = append(this.migrations, &sqliteMigration{
+			version: version,
+			up:      up,
+			down:    down,
+		})
+		//
+		sort.Slice(this.migrations, func(i, j int) bool {
+			return this.migrations[i].version < this.migrations[j].version
+		})
+		//
+		return nil
+	}
+	//
+	return fmt.Errorf("invalid migration")
+}
+
+// 已注册的最高版本
+func (this *SQLiteDB) SchemaVersion() int {
+	this.Lock()
+	defer this.Unlock()
+	//
+	if n := len(this.migrations); 0 < n {
+		return this.migrations[n-1].version
+	}
+	//
+	return 0
+}
+
+// 将备份文件迁移到指定版本，版本低于当前版本时执行回退
+func (this *SQLiteDB) MigrateTo(version int) error {
+	if "" != this.opts.backup_path {
+		return this.migrateFile(this.opts.backup_path, version)
+	}
+	return fmt.Errorf("no backup file path be provided")
+}
+
+func (this *SQLiteDB) migrateFile(backup string, version int) error {
+	if info, err := os.Stat(backup); nil == err {
+		if 0 < info.Size() {
+			// 加密的备份需要先解密，迁移后重新加密
+			path, cleanup, encrypted, err := this.openFile(backup)
+			//
+			if nil != err {
+				return err
+			}
+			//
+			defer cleanup()
+			//
+			changed, err := this.migrateDB(path, version)
+			//
+			if !changed {
+				return err
+			}
+			// 部分迁移成功时文件同样被修改
+			if encrypted {
+				if _err := this.sealDB(path, backup); nil != _err {
+					return _err
+				}
+			}
+			// 迁移后文件内容改变，需要更新校验文件
+			if _err := sqliteWriteChecksum(backup); nil != _err {
+				return _err
+			}
+			//
+			return err
+		}
+		return nil
+	} else if os.IsNotExist(err) {
+		return nil
+	} else {
+		return err
+	}
+}
+
+// 迁移数据源dsn对应的数据库，返回是否有修改
+func (this *SQLiteDB) migrateDB(dsn string, version int) (bool, error) {
+	if db, err := sql.Open("sqlite3", dsn); nil == err {
+		//
+		defer db.Close()
+		//
+		this.Lock()
+		//
+		list := this.migrations
+		//
+		this.Unlock()
+		//
+		return sqliteMigrate(db, list, version)
+	} else {
+		return false, err
+	}
+}
+
+// 将内存数据库标记为最新版本，使后续备份带上版本号
+func (this *SQLiteDB) markSchemaVersion() error {
+	if version := this.SchemaVersion(); 0 < version {
+		if conn, err := this.GetConn(true); nil == err {
+			_, err = conn.Exec(fmt.Sprintf("PRAGMA main.user_version = %d;", version))
+			return err
+		} else {
+			return err
+		}
+	}
+	return nil
+}
+
+// 返回备份文件是否被修改
+func sqliteMigrate(db *sql.DB, list []*sqliteMigration, target int) (bool, error) {
+	var current int
+	//
+	if err := db.QueryRow("PRAGMA main.user_version;").Scan(&current); nil != err {
+		return false, err
+	}
+	//
+	if current == target {
+		return false, nil
+	}
+	//
+	latest := 0
+	//
+	if n := len(list); 0 < n {
+		latest = list[n-1].version
+	}
+	// 备份文件来自更新的版本，或者目标版本未注册
+	if current > latest {
+		return false, fmt.Errorf("database version %d is newer than registered migrations", current)
+	}
+	//
+	if target > latest {
+		return false, fmt.Errorf("migration %d not registered", target)
+	}
+	//
+	// 有迁移步骤提交后备份文件才被修改
+	changed := false
+	//
+	if current < target {
+		for _, item := range list {
+			if current < item.version && target >= item.version {
+				//
+				logs.Info("数据库迁移: %d -> %d", current, item.version)
+				//
+				if err := sqliteMigrateStep(db, item.up, item.version); nil == err {
+					current, changed = item.version, true
+				} else {
+					return changed, fmt.Errorf("migration %d up failed, %w", item.version, err)
+				}
+			}
+		}
+	} else {
+		for i := len(list) - 1; 0 <= i; i-- {
+			if item := list[i]; target < item.version && current >= item.version {
+				//
+				if nil == item.down {
+					return changed, fmt.Errorf("migration %d has no down step", item.version)
+				}
+				//
+				version := target
+				//
+				if 0 < i && target < list[i-1].version {
+					version = list[i-1].version
+				}
+				//
+				logs.Info("数据库回退: %d -> %d", current, version)
+				//
+				if err := sqliteMigrateStep(db, item.down, version); nil == err {
+					current, changed = version, true
+				} else {
+					return changed, fmt.Errorf("migration %d down failed, %w", item.version, err)
+				}
+			}
+		}
+	}
+	//
+	// 目标版本未注册时直接标记
+	if current != target {
+		if _, err := db.Exec(fmt.Sprintf("PRAGMA main.user_version = %d;", target)); nil != err {
+			return changed, err
+		}
+	}
+	//
+	return true, nil
+}
+
+func sqliteMigrateStep(db *sql.DB, fn func(*sql.Tx) error, version int) error {
+	if tx, err := db.Begin(); nil == err {
+		//
+		if err := fn(tx); nil != err {
+			tx.Rollback()
+			return err
+		}
+		//
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA main.user_version = %d;", version)); nil != err {
+			tx.Rollback()
+			return err
+		}
+		//
+		return tx.Commit()
+	} else {
+		return err
+	}
+}
@@ -0,0 +1,109 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+)
+
+func testMigration(version int, up, down string) *sqliteMigration {
+	return &sqliteMigration{
+		version: version,
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(up)
+			return err
+		},
+		down: func(tx *sql.Tx) error {
+			_, err := tx.Exec(down)
+			return err
+		},
+	}
+}
+
+// 返回版本号及已创建的表
+func testSchema(t *testing.T, db *sql.DB) string {
+	//
+	var version int
+	var tables sql.NullString
+	//
+	if err := db.QueryRow("PRAGMA main.user_version;").Scan(&version); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if err := db.QueryRow("SELECT group_concat(name, ',') FROM (SELECT name FROM sqlite_master WHERE type == 'table' ORDER BY name);").Scan(&tables); nil != err {
+		t.Fatal(err)
+	}
+	//
+	return fmt.Sprintf("%d:%s", version, tables.String)
+}
+
+// 升级、回退及跳过未注册的版本
+func TestMigrateUpDown(t *testing.T) {
+	//
+	db, err := sql.Open("sqlite3", ":memory:")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer db.Close()
+	//
+	db.SetMaxOpenConns(1)
+	// 版本2未注册
+	list := []*sqliteMigration{
+		testMigration(1, "CREATE TABLE a (id INTEGER PRIMARY KEY);", "DROP TABLE a;"),
+		testMigration(3, "CREATE TABLE c (id INTEGER PRIMARY KEY);", "DROP TABLE c;"),
+	}
+	//
+	for _, item := range []struct {
+		target   int
+		expected string
+	}{
+		{2, "2:a"},
+		{3, "3:a,c"},
+		{3, "3:a,c"},
+		{1, "1:a"},
+		{0, "0:"},
+	} {
+		if _, err := sqliteMigrate(db, list, item.target); nil != err {
+			t.Fatal(err)
+		} else if result := testSchema(t, db); item.expected != result {
+			t.Fatalf("migrate to %d, result %s, expected %s", item.target, result, item.expected)
+		}
+	}
+	//
+	if _, err := sqliteMigrate(db, list, 4); nil == err {
+		t.Fatal("unregistered version accepted")
+	}
+}
+
+// 只有迁移步骤提交后才报告修改
+func TestMigrateFailed(t *testing.T) {
+	//
+	db, err := sql.Open("sqlite3", ":memory:")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer db.Close()
+	//
+	db.SetMaxOpenConns(1)
+	//
+	list := []*sqliteMigration{
+		testMigration(1, "CREATE TABLE a (id INTEGER PRIMARY KEY);", "DROP TABLE a;"),
+		testMigration(2, "INSERT INTO b VALUES (1);", "DELETE FROM b;"),
+	}
+	//
+	if changed, err := sqliteMigrate(db, list[1:], 2); nil == err || changed {
+		t.Fatalf("first step failed, changed %v, %v", changed, err)
+	} else if result := testSchema(t, db); "0:" != result {
+		t.Fatalf("result %s", result)
+	}
+	//
+	if changed, err := sqliteMigrate(db, list, 2); nil == err || !changed {
+		t.Fatalf("second step failed, changed %v, %v", changed, err)
+	} else if result := testSchema(t, db); "1:a" != result {
+		t.Fatalf("result %s", result)
+	}
+}
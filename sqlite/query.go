@@ -0,0 +1,400 @@
+package sqlite
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var (
+	ENoStruct     = errors.New("value must be a pointer to struct")
+	ENoSlice      = errors.New("value must be a pointer to slice of struct")
+	ENoPrimaryKey = errors.New("struct has no primary key field")
+
+	fieldCache sync.Map
+)
+
+type sqliteField struct {
+	index  []int
+	column string
+
+	// 主键
+	pk bool
+	// 自增，插入时为零值则由数据库分配
+	auto bool
+}
+
+// 解析结构体字段，标签格式为`sqlite:"列名,pk,auto"`，"-"表示忽略，未设置标签时列名为小写的字段名
+// 匿名结构体及导出的匿名结构体指针展开，指针为nil时读取的列为NULL，查询时分配
+func sqliteStructFields(t reflect.Type) []*sqliteField {
+	//
+	if result, ok := fieldCache.Load(t); ok {
+		return result.([]*sqliteField)
+	}
+	//
+	list := sqliteParseFields(t, map[reflect.Type]bool{})
+	//
+	fieldCache.Store(t, list)
+	//
+	return list
+}
+
+// seen为正在展开的类型，避免嵌入自身指针时无限递归
+func sqliteParseFields(t reflect.Type, seen map[reflect.Type]bool) []*sqliteField {
+	//
+	seen[t] = true
+	//
+	defer delete(seen, t)
+	//
+	var list []*sqliteField
+	//
+	for i := 0; t.NumField() > i; i++ {
+		//
+		f := t.Field(i)
+		//
+		tag := f.Tag.Get("sqlite")
+		//
+		if "-" == tag {
+			continue
+		}
+		// 匿名结构体展开，未导出的结构体指针无法分配，与其余未导出字段一样忽略
+		if f.Anonymous && "" == tag {
+			//
+			ft := f.Type
+			//
+			if reflect.Ptr == ft.Kind() && reflect.Struct == ft.Elem().Kind() {
+				if "" != f.PkgPath || seen[ft.Elem()] {
+					continue
+				}
+				ft = ft.Elem()
+			}
+			//
+			if reflect.Struct == ft.Kind() && !seen[ft] {
+				for _, item := range sqliteParseFields(ft, seen) {
+					list = append(list, &sqliteField{
+						index:  append([]int{i}, item.index...),
+						column: item.column,
+						pk:     item.pk,
+						auto:   item.auto,
+					})
+				}
+				continue
+			}
+		}
+		// 忽略未导出字段
+		if "" != f.PkgPath {
+			continue
+		}
+		//
+		field := &sqliteField{
+			index:  []int{i},
+			column: strings.ToLower(f.Name),
+		}
+		//
+		for j, item := range strings.Split(tag, ",") {
+			if item = strings.TrimSpace(item); 0 == j {
+				if "" != item {
+					field.column = item
+				}
+			} else {
+				switch item {
+				case "pk":
+					field.pk = true
+				case "auto":
+					field.auto = true
+				}
+			}
+		}
+		//
+		list = append(list, field)
+	}
+	//
+	return list
+}
+
+// 按字段序号取值，经过为nil的匿名结构体指针时，alloc为true则分配，否则返回无效值
+func sqliteFieldByIndex(v reflect.Value, index []int, alloc bool) reflect.Value {
+	for i, x := range index {
+		if 0 < i && reflect.Ptr == v.Kind() {
+			if v.IsNil() {
+				if !alloc {
+					return reflect.Value{}
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// 字段的值，所在的匿名结构体指针为nil时为NULL
+func sqliteFieldArg(v reflect.Value, index []int) interface{} {
+	if fv := sqliteFieldByIndex(v, index, false); fv.IsValid() {
+		return fv.Interface()
+	}
+	return nil
+}
+
+func sqliteStructValue(v interface{}) (reflect.Value, error) {
+	if rv := reflect.ValueOf(v); reflect.Ptr == rv.Kind() && !rv.IsNil() {
+		if rv = rv.Elem(); reflect.Struct == rv.Kind() {
+			return rv, nil
+		}
+	}
+	return reflect.Value{}, ENoStruct
+}
+
+// 按"schema.table"格式转义表名
+func sqliteQuoteTable(name string) string {
+	if i := strings.IndexByte(name, '.'); 0 < i {
+		switch strings.ToLower(name[:i]) {
+		case "main", "temp":
+			return name[:i] + "." + sqliteQuote(name[i+1:])
+		}
+	}
+	return sqliteQuote(name)
+}
+
+// 插入一行，自增主键为零值时由数据库分配并回写到结构体
+func (this *SQLiteDB) Insert(table string, v interface{}) (int64, error) {
+	//
+	rv, err := sqliteStructValue(v)
+	//
+	if nil != err {
+		return 0, err
+	}
+	//
+	var columns []string
+	var args []interface{}
+	var auto *sqliteField
+	//
+	for _, field := range sqliteStructFields(rv.Type()) {
+		//
+		fv := sqliteFieldByIndex(rv, field.index, false)
+		//
+		if field.auto && (!fv.IsValid() || sqliteIsZero(fv)) {
+			auto = field
+			continue
+		}
+		//
+		columns = append(columns, field.column)
+		args = append(args, sqliteFieldArg(rv, field.index))
+	}
+	//
+	if conn, err := this.GetConn(true); nil == err {
+		//
+		var query string
+		//
+		if 0 < len(columns) {
+			query = fmt.Sprintf(
+				"INSERT INTO %s (%s) VALUES (?%s);",
+				sqliteQuoteTable(table),
+				sqliteQuoteList(columns),
+				strings.Repeat(", ?", len(columns)-1),
+			)
+		} else {
+			query = fmt.Sprintf("INSERT INTO %s DEFAULT VALUES;", sqliteQuoteTable(table))
+		}
+		//
+		if result, err := conn.Exec(query, args...); nil == err {
+			if id, err := result.LastInsertId(); nil == err {
+				//
+				if nil != auto {
+					if fv := sqliteFieldByIndex(rv, auto.index, true); fv.CanSet() {
+						switch fv.Kind() {
+						case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+							fv.SetInt(id)
+						case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+							fv.SetUint(uint64(id))
+						}
+					}
+				}
+				//
+				return id, nil
+			} else {
+				return 0, err
+			}
+		} else {
+			return 0, err
+		}
+	} else {
+		return 0, err
+	}
+}
+
+// 插入一行，主键冲突时更新其余列
+func (this *SQLiteDB) Upsert(table string, v interface{}) error {
+	//
+	rv, err := sqliteStructValue(v)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	var columns, keys, updates []string
+	var args []interface{}
+	//
+	for _, field := range sqliteStructFields(rv.Type()) {
+		//
+		columns = append(columns, field.column)
+		args = append(args, sqliteFieldArg(rv, field.index))
+		//
+		if field.pk {
+			keys = append(keys, field.column)
+		} else {
+			updates = append(updates, fmt.Sprintf("%s=excluded.%s", sqliteQuote(field.column), sqliteQuote(field.column)))
+		}
+	}
+	//
+	if 0 == len(keys) {
+		return ENoPrimaryKey
+	}
+	//
+	action := "NOTHING"
+	//
+	if 0 < len(updates) {
+		action = "UPDATE SET " + strings.Join(updates, ", ")
+	}
+	//
+	if conn, err := this.GetConn(true); nil == err {
+		_, err := conn.Exec(fmt.Sprintf(
+			"INSERT INTO %s (%s) VALUES (?%s) ON CONFLICT (%s) DO %s;",
+			sqliteQuoteTable(table),
+			sqliteQuoteList(columns),
+			strings.Repeat(", ?", len(columns)-1),
+			sqliteQuoteList(keys),
+			action,
+		), args...)
+		return err
+	} else {
+		return err
+	}
+}
+
+// 按主键删除一行，返回删除的行数
+func (this *SQLiteDB) Delete(table string, v interface{}) (int64, error) {
+	//
+	rv, err := sqliteStructValue(v)
+	//
+	if nil != err {
+		return 0, err
+	}
+	//
+	var where []string
+	var args []interface{}
+	//
+	for _, field := range sqliteStructFields(rv.Type()) {
+		if field.pk {
+			where = append(where, fmt.Sprintf("%s=?", sqliteQuote(field.column)))
+			args = append(args, sqliteFieldArg(rv, field.index))
+		}
+	}
+	//
+	if 0 == len(where) {
+		return 0, ENoPrimaryKey
+	}
+	//
+	if conn, err := this.GetConn(true); nil == err {
+		if result, err := conn.Exec(fmt.Sprintf(
+			"DELETE FROM %s WHERE %s;",
+			sqliteQuoteTable(table),
+			strings.Join(where, " AND "),
+		), args...); nil == err {
+			return result.RowsAffected()
+		} else {
+			return 0, err
+		}
+	} else {
+		return 0, err
+	}
+}
+
+// 查询结果写入结构体切片，dst为*[]T或*[]*T，where为可选的条件语句(不含WHERE)，参数使用占位符
+func (this *SQLiteDB) Select(dst interface{}, table string, where string, args ...interface{}) error {
+	//
+	rv := reflect.ValueOf(dst)
+	//
+	if reflect.Ptr != rv.Kind() || rv.IsNil() || reflect.Slice != rv.Elem().Kind() {
+		return ENoSlice
+	}
+	//
+	slice := rv.Elem()
+	//
+	et := slice.Type().Elem()
+	//
+	isPtr := reflect.Ptr == et.Kind()
+	//
+	if isPtr {
+		et = et.Elem()
+	}
+	//
+	if reflect.Struct != et.Kind() {
+		return ENoSlice
+	}
+	//
+	fields := sqliteStructFields(et)
+	//
+	columns := make([]string, len(fields))
+	//
+	for i, field := range fields {
+		columns[i] = field.column
+	}
+	//
+	query := fmt.Sprintf("SELECT %s FROM %s", sqliteQuoteList(columns), sqliteQuoteTable(table))
+	//
+	if "" != strings.TrimSpace(where) {
+		query += " WHERE " + where
+	}
+	//
+	if conn, err := this.GetConn(true); nil == err {
+		if rows, err := conn.Query(query+";", args...); nil == err {
+			//
+			defer rows.Close()
+			//
+			targets := make([]interface{}, len(fields))
+			//
+			for rows.Next() {
+				//
+				item := reflect.New(et)
+				//
+				for i, field := range fields {
+					targets[i] = sqliteFieldByIndex(item.Elem(), field.index, true).Addr().Interface()
+				}
+				//
+				if err := rows.Scan(targets...); nil != err {
+					return err
+				}
+				//
+				if isPtr {
+					slice = reflect.Append(slice, item)
+				} else {
+					slice = reflect.Append(slice, item.Elem())
+				}
+			}
+			//
+			rv.Elem().Set(slice)
+			//
+			return rows.Err()
+		} else {
+			return err
+		}
+	} else {
+		return err
+	}
+}
+
+func sqliteIsZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return 0 == v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return 0 == v.Uint()
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
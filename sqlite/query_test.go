@@ -0,0 +1,90 @@
+package sqlite
+
+import (
+	"testing"
+)
+
+type testQueryBase struct {
+	ID int64 `sqlite:"id,pk,auto"`
+}
+
+type testQueryExtra struct {
+	Note string
+}
+
+type testQueryRow struct {
+	testQueryBase
+	// 未导出的结构体指针被忽略
+	*testQueryExtra
+	*TestQueryExtra
+
+	Name    string `sqlite:"title"`
+	Ignored string `sqlite:"-"`
+}
+
+type TestQueryExtra struct {
+	Extra *string
+}
+
+// 匿名结构体及其指针展开为列，指针为nil时写入NULL，查询时分配
+func TestQueryStructMapping(t *testing.T) {
+	//
+	db, conn := testOpen(t, WithName(testName(t)))
+	//
+	defer db.Close()
+	//
+	if _, err := conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, extra TEXT, title TEXT);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	extra := "x"
+	//
+	list := []*testQueryRow{
+		{Name: "a"},
+		{Name: "b", TestQueryExtra: &TestQueryExtra{Extra: &extra}},
+	}
+	//
+	for i, item := range list {
+		if id, err := db.Insert("t", item); nil != err {
+			t.Fatal(err)
+		} else if int64(i+1) != id || id != item.ID {
+			t.Fatalf("inserted id %d, field %d", id, item.ID)
+		}
+	}
+	//
+	var result []testQueryRow
+	//
+	if err := db.Select(&result, "t", "id > ? ORDER BY id", 0); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if 2 != len(result) || "a" != result[0].Name || nil != result[0].Extra || nil == result[1].Extra || "x" != *result[1].Extra {
+		t.Fatalf("selected %+v", result)
+	}
+	//
+	var kind string
+	//
+	if err := conn.QueryRow("SELECT typeof(extra) FROM t WHERE 1 == id;").Scan(&kind); nil != err {
+		t.Fatal(err)
+	} else if "null" != kind {
+		t.Fatalf("nil embedded pointer stored as %s", kind)
+	}
+	//
+	list[0].Name = "c"
+	//
+	if err := db.Upsert("t", list[0]); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if n, err := db.Delete("t", list[1]); nil != err || 1 != n {
+		t.Fatalf("deleted %d rows, %v", n, err)
+	}
+	//
+	var ptrs []*testQueryRow
+	//
+	if err := db.Select(&ptrs, "t", ""); nil != err {
+		t.Fatal(err)
+	} else if 1 != len(ptrs) || "c" != ptrs[0].Name || 1 != ptrs[0].ID {
+		t.Fatalf("selected %+v", ptrs)
+	}
+}
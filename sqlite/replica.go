@@ -0,0 +1,612 @@
+package sqlite
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elitah/utils/logs"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// 复制协议的帧类型，帧格式与日志记录相同，内容第一个字节为类型
+	replicaSnapshot    = 'S' // 快照数据块
+	replicaSnapshotEnd = 'E' // 快照结束
+	replicaChanges     = 'C' // 变化记录
+	replicaPing        = 'P' // 心跳
+	replicaHello       = 'H' // 备机连接后发送的随机数，仅在设置了共享密钥时使用
+
+	// 随机数及帧签名的长度
+	replicaNonceSize = 16
+	replicaMACSize   = sha256.Size
+
+	// 快照数据块长度
+	replicaChunkSize = 64 * 1024
+
+	// 心跳间隔及读写超时
+	replicaPingInterval = 5 * time.Second
+	replicaTimeout      = 15 * time.Second
+
+	// 待发送变化的上限，超出时断开连接，备机重连后重新同步快照
+	replicaQueueMax = 64 * 1024
+)
+
+var (
+	EReplicaLagging = errors.New("replica lagging behind")
+	EReplicaAuth    = errors.New("replication frame authentication failed")
+)
+
+// 复制连接的共享密钥，主机与备机须相同
+// 设置后备机连接时发送随机数，主机发送的每帧附带以密钥及随机数派生的HMAC-SHA256签名，帧序号参与签名，不能重放或调换顺序
+// 未设置时不做认证，连接须已经过认证(如TLS双向认证)，否则任何能连接的一方都可以替换备机的数据
+func WithReplicaSecret(secret string) Option {
+	if "" != secret {
+		return func(opts *options) {
+			opts.replica_secret = []byte(secret)
+		}
+	}
+	return nil
+}
+
+// 单个连接的帧签名，为nil时不签名
+type sqliteFrameAuth struct {
+	key []byte
+	seq uint64
+}
+
+func newFrameAuth(secret, nonce []byte) *sqliteFrameAuth {
+	//
+	if 0 == len(secret) {
+		return nil
+	}
+	//
+	h := hmac.New(sha256.New, secret)
+	//
+	h.Write(nonce)
+	//
+	return &sqliteFrameAuth{
+		key: h.Sum(nil),
+	}
+}
+
+func (this *sqliteFrameAuth) sum(data []byte) []byte {
+	//
+	var seq [8]byte
+	//
+	binary.BigEndian.PutUint64(seq[:], this.seq)
+	//
+	this.seq++
+	//
+	h := hmac.New(sha256.New, this.key)
+	//
+	h.Write(seq[:])
+	h.Write(data)
+	//
+	return h.Sum(nil)
+}
+
+func (this *sqliteFrameAuth) seal(data []byte) []byte {
+	if nil != this {
+		return append(data, this.sum(data)...)
+	}
+	return data
+}
+
+func (this *sqliteFrameAuth) open(data []byte) ([]byte, error) {
+	if nil != this {
+		//
+		if replicaMACSize > len(data) {
+			return nil, EReplicaAuth
+		}
+		//
+		n := len(data) - replicaMACSize
+		//
+		if !hmac.Equal(this.sum(data[:n]), data[n:]) {
+			return nil, EReplicaAuth
+		}
+		//
+		return data[:n], nil
+	}
+	return data, nil
+}
+
+type sqliteReplicaStream struct {
+	sync.Mutex
+
+	conn net.Conn
+
+	auth *sqliteFrameAuth
+
+	queue []sqliteChange
+
+	err error
+
+	notify chan struct{}
+	closed chan struct{}
+
+	once sync.Once
+}
+
+func newReplicaStream(conn net.Conn) *sqliteReplicaStream {
+	return &sqliteReplicaStream{
+		conn:   conn,
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+// 由提交钩子调用，不能阻塞
+func (this *sqliteReplicaStream) Push(list []sqliteChange) {
+	//
+	this.Lock()
+	//
+	if replicaQueueMax < len(this.queue)+len(list) {
+		//
+		this.err = EReplicaLagging
+		//
+		this.Unlock()
+		//
+		this.Close()
+		//
+		return
+	}
+	//
+	this.queue = append(this.queue, list...)
+	//
+	this.Unlock()
+	//
+	select {
+	case this.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (this *sqliteReplicaStream) Take() (list []sqliteChange) {
+	this.Lock()
+	defer this.Unlock()
+	//
+	list, this.queue = this.queue, nil
+	//
+	return
+}
+
+func (this *sqliteReplicaStream) Err() error {
+	this.Lock()
+	defer this.Unlock()
+	//
+	return this.err
+}
+
+func (this *sqliteReplicaStream) Close() {
+	this.once.Do(func() {
+		close(this.closed)
+	})
+}
+
+func (this *sqliteReplicaStream) send(kind byte, payload []byte) error {
+	//
+	this.conn.SetWriteDeadline(time.Now().Add(replicaTimeout))
+	//
+	_, err := this.conn.Write(sqliteJournalAppend(nil, this.auth.seal(append([]byte{kind}, payload...))))
+	//
+	return err
+}
+
+// 作为主机在l上接受备机连接，直到l被关闭，未设置WithReplicaSecret时l须只接受已认证的连接
+func (this *SQLiteDB) ServeReplication(l net.Listener) error {
+	for {
+		if conn, err := l.Accept(); nil == err {
+			go func() {
+				if err := this.ServeReplica(conn); nil != err {
+					logs.Warn("replica %v disconnected, %v", conn.RemoteAddr(), err)
+				}
+			}()
+		} else {
+			return err
+		}
+	}
+}
+
+// 向单个备机发送快照及之后的变化，直到连接断开或数据库关闭
+func (this *SQLiteDB) ServeReplica(conn net.Conn) error {
+	//
+	defer conn.Close()
+	//
+	db, err := this.GetConn()
+	//
+	if nil != err {
+		return err
+	}
+	//
+	r := newReplicaStream(conn)
+	// 设置了共享密钥时先读取备机的随机数
+	if 0 < len(this.opts.replica_secret) {
+		//
+		conn.SetReadDeadline(time.Now().Add(replicaTimeout))
+		//
+		data, err := sqliteReadFrame(conn)
+		//
+		if nil != err {
+			return err
+		}
+		//
+		if 1+replicaNonceSize != len(data) || replicaHello != data[0] {
+			return EReplicaAuth
+		}
+		//
+		conn.SetReadDeadline(time.Time{})
+		//
+		r.auth = newFrameAuth(this.opts.replica_secret, data[1:])
+	}
+	// 先登记再生成快照，快照期间的变化不会丢失，重复应用的结果不变
+	this.store.AddReplica(r)
+	//
+	defer this.store.RemoveReplica(r)
+	//
+	version, err := this.sendSnapshot(r)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	logs.Info("replica %v synchronized", conn.RemoteAddr())
+	//
+	ticker := time.NewTicker(replicaPingInterval)
+	//
+	defer ticker.Stop()
+	//
+	for {
+		select {
+		case <-r.notify:
+			//
+			list := r.Take()
+			//
+			var current int64
+			//
+			if err := db.QueryRow("PRAGMA main.schema_version;").Scan(&current); nil != err {
+				return err
+			}
+			// 表结构发生变化，重新发送快照
+			if current != version {
+				if version, err = this.sendSnapshot(r); nil != err {
+					return err
+				}
+				continue
+			}
+			//
+			if records := sqliteEncodeChanges(db, list); 0 < len(records) {
+				if data, err := json.Marshal(records); nil == err {
+					if err := r.send(replicaChanges, data); nil != err {
+						return err
+					}
+				} else {
+					return err
+				}
+			}
+		case <-ticker.C:
+			if err := r.send(replicaPing, nil); nil != err {
+				return err
+			}
+		case <-r.closed:
+			if err := r.Err(); nil != err {
+				return err
+			}
+			return io.EOF
+		}
+	}
+}
+
+// 备份到临时文件后分块发送，返回快照时的表结构版本
+func (this *SQLiteDB) sendSnapshot(r *sqliteReplicaStream) (int64, error) {
+	//
+	f, err := ioutil.TempFile(this.replicaDir(), "replica-*.db")
+	//
+	if nil != err {
+		return 0, err
+	}
+	//
+	path := f.Name()
+	//
+	f.Close()
+	//
+	defer os.Remove(path)
+	//
+	var version int64
+	//
+	if err := this.snapshot(path, func(db *sql.DB) error {
+		return db.QueryRow("PRAGMA main.schema_version;").Scan(&version)
+	}); nil != err {
+		return 0, err
+	}
+	//
+	if f, err := os.Open(path); nil == err {
+		//
+		defer f.Close()
+		//
+		buf := make([]byte, replicaChunkSize)
+		//
+		for {
+			if n, err := f.Read(buf); 0 < n {
+				if err := r.send(replicaSnapshot, buf[:n]); nil != err {
+					return 0, err
+				}
+			} else if io.EOF == err {
+				break
+			} else if nil != err {
+				return 0, err
+			}
+		}
+	} else {
+		return 0, err
+	}
+	//
+	return version, r.send(replicaSnapshotEnd, nil)
+}
+
+// 持有备份锁将数据库复制到path，fn在复制前调用
+func (this *SQLiteDB) snapshot(path string, fn func(*sql.DB) error) error {
+	//
+	db, err := this.GetConn()
+	//
+	if nil != err {
+		return err
+	}
+	//
+	if err := this.lockBackup(context.Background()); nil != err {
+		return err
+	}
+	//
+	defer this.unlockBackup()
+	//
+	master := this.store.Get()
+	//
+	if nil == master {
+		return fmt.Errorf("no master connection be found")
+	}
+	//
+	if nil != fn {
+		if err := fn(db); nil != err {
+			return err
+		}
+	}
+	//
+	return sqliteBackupFile(master, path, false, this.opts.backup_step, this.opts.backup_delay)
+}
+
+// 快照临时文件所在目录，有备份路径时与备份文件放在一起
+func (this *SQLiteDB) replicaDir() string {
+	if "" != this.opts.backup_path {
+		return filepath.Dir(this.opts.backup_path)
+	}
+	return ""
+}
+
+// 在内存数据库与文件之间复制，load为true时从文件读入conn，否则将conn写入文件
+func sqliteBackupFile(conn *sqlite3.SQLiteConn, path string, load bool, step, delay int) error {
+	if c, err := (&sqlite3.SQLiteDriver{}).Open(path); nil == err {
+		//
+		defer c.Close()
+		//
+		if file, ok := c.(*sqlite3.SQLiteConn); ok {
+			if load {
+				return SQLiteBackup(file, conn, step, delay)
+			}
+			return SQLiteBackup(conn, file, step, delay)
+		}
+		//
+		return fmt.Errorf("unexpected connection type %T", c)
+	} else {
+		return err
+	}
+}
+
+// 作为备机从主机同步数据，连接断开后等待delay重新连接并重新同步快照，直到ctx结束或数据库关闭
+func (this *SQLiteDB) ReplicateFrom(ctx context.Context, dial func() (net.Conn, error), delay time.Duration) error {
+	for {
+		//
+		if 0x0 != atomic.LoadUint32(&this.opts.flag_groups[FlagStatus]) {
+			return fmt.Errorf("database was closed")
+		}
+		//
+		if conn, err := dial(); nil == err {
+			if err := this.replicate(ctx, conn); nil != err && nil == ctx.Err() {
+				logs.Warn("replication from %v interrupted, %v", conn.RemoteAddr(), err)
+			}
+		} else {
+			logs.Warn("unable connect to primary, %v", err)
+		}
+		//
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (this *SQLiteDB) replicate(ctx context.Context, conn net.Conn) error {
+	//
+	defer conn.Close()
+	//
+	done := make(chan struct{})
+	//
+	defer close(done)
+	// ctx结束时关闭连接以打断读取
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	//
+	db, err := this.GetConn()
+	//
+	if nil != err {
+		return err
+	}
+	//
+	var snapshot *os.File
+	//
+	defer func() {
+		if nil != snapshot {
+			snapshot.Close()
+			os.Remove(snapshot.Name())
+		}
+	}()
+	//
+	synced := false
+	//
+	var auth *sqliteFrameAuth
+	//
+	if 0 < len(this.opts.replica_secret) {
+		//
+		nonce := make([]byte, replicaNonceSize)
+		//
+		if _, err := rand.Read(nonce); nil != err {
+			return err
+		}
+		//
+		conn.SetWriteDeadline(time.Now().Add(replicaTimeout))
+		//
+		if _, err := conn.Write(sqliteJournalAppend(nil, append([]byte{replicaHello}, nonce...))); nil != err {
+			return err
+		}
+		//
+		auth = newFrameAuth(this.opts.replica_secret, nonce)
+	}
+	//
+	br := bufio.NewReader(conn)
+	//
+	for {
+		//
+		conn.SetReadDeadline(time.Now().Add(replicaTimeout))
+		//
+		data, err := sqliteReadFrame(br)
+		//
+		if nil != err {
+			return err
+		}
+		//
+		if data, err = auth.open(data); nil != err {
+			return err
+		}
+		//
+		if 0 == len(data) {
+			return EJournalCorrupt
+		}
+		//
+		switch kind, payload := data[0], data[1:]; kind {
+		case replicaSnapshot:
+			//
+			if nil == snapshot {
+				if snapshot, err = ioutil.TempFile(this.replicaDir(), "replica-*.db"); nil != err {
+					return err
+				}
+			}
+			//
+			if _, err := snapshot.Write(payload); nil != err {
+				return err
+			}
+		case replicaSnapshotEnd:
+			//
+			if nil == snapshot {
+				return EJournalCorrupt
+			}
+			//
+			snapshot.Close()
+			//
+			err := this.loadSnapshot(ctx, snapshot.Name())
+			//
+			os.Remove(snapshot.Name())
+			//
+			snapshot = nil
+			//
+			if nil != err {
+				return err
+			}
+			//
+			if !synced {
+				logs.Info("replica synchronized from %v", conn.RemoteAddr())
+			}
+			//
+			synced = true
+		case replicaChanges:
+			//
+			if !synced {
+				return EJournalCorrupt
+			}
+			//
+			// 值只能是标量，应用时作为参数绑定
+			var records []*sqliteJournalRecord
+			//
+			if err := json.Unmarshal(payload, &records); nil != err {
+				return err
+			}
+			//
+			if tx, err := db.Begin(); nil == err {
+				//
+				for _, record := range records {
+					if err := sqliteApplyRecord(tx, record); nil != err {
+						tx.Rollback()
+						return err
+					}
+				}
+				//
+				if err := tx.Commit(); nil != err {
+					return err
+				}
+			} else {
+				return err
+			}
+		case replicaPing:
+		default:
+			return fmt.Errorf("unknown replication frame %q", kind)
+		}
+	}
+}
+
+// 用快照替换当前数据
+func (this *SQLiteDB) loadSnapshot(ctx context.Context, path string) error {
+	//
+	if err := this.lockBackup(ctx); nil != err {
+		return err
+	}
+	//
+	defer this.unlockBackup()
+	//
+	master := this.store.Get()
+	//
+	if nil == master {
+		return fmt.Errorf("no master connection be found")
+	}
+	//
+	if err := sqliteBackupFile(master, path, true, this.opts.backup_step, this.opts.backup_delay); nil != err {
+		return err
+	}
+	// 整库替换不经过更新钩子，下次需要全量备份
+	atomic.StoreInt64(&this.schema, -1)
+	// 表结构可能已变化，重新安装日志触发器
+	if nil != this.journal {
+		this.journal.Refresh()
+	}
+	//
+	return nil
+}
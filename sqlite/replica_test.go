@@ -0,0 +1,158 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func testWaitCount(t *testing.T, db *SQLiteDB, expected int) {
+	//
+	conn, err := db.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	var cnt int
+	//
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if err := conn.QueryRow("SELECT COUNT(*) FROM t;").Scan(&cnt); nil == err && expected == cnt {
+			return
+		}
+	}
+	//
+	t.Fatalf("replica has %d rows, expected %d", cnt, expected)
+}
+
+// 在本机回环地址上复制，快照及之后的变化都同步到备机，密钥不同的备机拒绝主机的帧
+func TestReplicaLoopback(t *testing.T) {
+	//
+	primary := NewSQLiteDB(WithName(t.Name()+"_primary"), WithReplicaSecret("secret"))
+	//
+	defer primary.Close()
+	//
+	conn, err := primary.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v); INSERT INTO t (v) VALUES ('first');"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer l.Close()
+	//
+	go primary.ServeReplication(l)
+	//
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	}
+	//
+	replica := NewSQLiteDB(WithName(t.Name()+"_replica"), WithReplicaSecret("secret"))
+	//
+	defer replica.Close()
+	//
+	rconn, err := replica.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	ctx, cancel := context.WithCancel(context.Background())
+	//
+	defer cancel()
+	//
+	go replica.ReplicateFrom(ctx, dial, 100*time.Millisecond)
+	//
+	testWaitCount(t, replica, 1)
+	//
+	for _, v := range []interface{}{int64(1), 1.5, "x'); DROP TABLE t; --", []byte{0, 1}, nil} {
+		if _, err := conn.Exec("INSERT INTO t (v) VALUES (?);", v); nil != err {
+			t.Fatal(err)
+		}
+	}
+	//
+	testWaitCount(t, replica, 6)
+	//
+	var expected, result string
+	//
+	query := "SELECT group_concat(typeof(v) || ':' || quote(v), ',') FROM t;"
+	//
+	if err := conn.QueryRow(query).Scan(&expected); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if err := rconn.QueryRow(query).Scan(&result); nil != err {
+		t.Fatal(err)
+	} else if expected != result {
+		t.Fatalf("replica %s, expected %s", result, expected)
+	}
+	// 密钥不同，主机发送的第一帧即校验失败
+	other := NewSQLiteDB(WithName(t.Name()+"_other"), WithReplicaSecret("other"))
+	//
+	defer other.Close()
+	//
+	if _, err := other.GetConn(); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if c, err := dial(); nil == err {
+		if err := other.replicate(ctx, c); !errors.Is(err, EReplicaAuth) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	} else {
+		t.Fatal(err)
+	}
+}
+
+// 伪造的帧没有正确的签名，备机断开连接且数据不变
+func TestReplicaForgedFrame(t *testing.T) {
+	//
+	replica := NewSQLiteDB(WithName(t.Name()), WithReplicaSecret("secret"))
+	//
+	defer replica.Close()
+	//
+	conn, err := replica.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn.Exec("CREATE TABLE t (v);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	c1, c2 := net.Pipe()
+	//
+	defer c2.Close()
+	//
+	go func() {
+		// 读取备机的随机数后发送没有签名的快照
+		if _, err := sqliteReadFrame(c2); nil == err {
+			c2.Write(sqliteJournalAppend(nil, append([]byte{replicaSnapshotEnd}, make([]byte, replicaMACSize)...)))
+		}
+	}()
+	//
+	if err := replica.replicate(context.Background(), c1); !errors.Is(err, EReplicaAuth) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	//
+	// 快照没有被替换，表仍然存在
+	var cnt int
+	//
+	if err := conn.QueryRow("SELECT COUNT(*) FROM t;").Scan(&cnt); nil != err {
+		t.Fatal(err)
+	} else if 0 != cnt {
+		t.Fatalf("replica has %d rows", cnt)
+	}
+}
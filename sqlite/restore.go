@@ -0,0 +1,243 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	ConflictSkip = iota
+	ConflictReplace
+	ConflictFail
+)
+
+type sqliteDumpFile struct {
+	SQL   string          `json:"sql"`
+	Count int64           `json:"count"`
+	List  [][]interface{} `json:"list"`
+}
+
+// 导入SQLiteSync导出的sqlite_backup_*.json文件
+// 表不存在时按文件中的建表语句创建，存在时按policy处理主键或唯一约束冲突
+func SQLiteRestoreJSON(db *sql.DB, path string, policy int) (int64, error) {
+	//
+	var dump sqliteDumpFile
+	//
+	if f, err := os.Open(path); nil == err {
+		//
+		decoder := json.NewDecoder(f)
+		// 保留数字原样，按列类型转换
+		decoder.UseNumber()
+		//
+		err = decoder.Decode(&dump)
+		//
+		f.Close()
+		//
+		if nil != err {
+			return 0, err
+		}
+	} else {
+		return 0, err
+	}
+	//
+	var verb string
+	//
+	switch policy {
+	case ConflictSkip:
+		verb = "INSERT OR IGNORE"
+	case ConflictReplace:
+		verb = "INSERT OR REPLACE"
+	case ConflictFail:
+		verb = "INSERT OR ABORT"
+	default:
+		return 0, fmt.Errorf("unknown conflict policy: %d", policy)
+	}
+	// 借助临时数据库解析建表语句
+	name, columns, err := sqliteParseCreate(dump.SQL)
+	//
+	if nil != err {
+		return 0, err
+	}
+	//
+	tx, err := db.Begin()
+	//
+	if nil != err {
+		return 0, err
+	}
+	//
+	var exists int
+	//
+	if err := tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type=='table' AND tbl_name==?;", name).Scan(&exists); nil != err {
+		tx.Rollback()
+		return 0, err
+	}
+	//
+	if 0 == exists {
+		if _, err := tx.Exec(dump.SQL); nil != err {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	// 表已存在时只写入与现有表相同的列，与SQLiteSync一致
+	live, err := sqliteColumnInfos(tx, name)
+	//
+	if nil != err {
+		tx.Rollback()
+		return 0, err
+	}
+	//
+	index := make(map[string]*sqliteColumnInfo)
+	//
+	for _, col := range live {
+		index[strings.ToLower(col.name)] = col
+	}
+	//
+	var names []string
+	// 导出文件中的列号及对应的现有列
+	var fields []int
+	var targets []*sqliteColumnInfo
+	//
+	for i, col := range columns {
+		if _col, ok := index[strings.ToLower(col.name)]; ok {
+			//
+			names = append(names, _col.name)
+			fields = append(fields, i)
+			targets = append(targets, _col)
+			//
+			delete(index, strings.ToLower(col.name))
+		}
+	}
+	//
+	if 0 == len(names) {
+		tx.Rollback()
+		return 0, fmt.Errorf("table %s has no common columns", name)
+	}
+	//
+	stmt, err := tx.Prepare(fmt.Sprintf(
+		"%s INTO %s (%s) VALUES (?%s);",
+		verb,
+		sqliteQuote(name),
+		sqliteQuoteList(names),
+		strings.Repeat(", ?", len(names)-1),
+	))
+	//
+	if nil != err {
+		tx.Rollback()
+		return 0, err
+	}
+	//
+	defer stmt.Close()
+	//
+	var cnt int64
+	//
+	args := make([]interface{}, len(fields))
+	//
+	for i, row := range dump.List {
+		//
+		if len(row) != len(columns) {
+			tx.Rollback()
+			return 0, fmt.Errorf("row %d has %d values, expect %d", i, len(row), len(columns))
+		}
+		//
+		for j, field := range fields {
+			if value, err := sqliteJSONValue(targets[j].ctype, row[field]); nil == err {
+				args[j] = value
+			} else {
+				tx.Rollback()
+				return 0, fmt.Errorf("row %d column %s, %w", i, targets[j].name, err)
+			}
+		}
+		//
+		if result, err := stmt.Exec(args...); nil == err {
+			if n, err := result.RowsAffected(); nil == err && 0 < n {
+				cnt++
+			}
+		} else {
+			tx.Rollback()
+			return 0, fmt.Errorf("row %d, %w", i, err)
+		}
+	}
+	//
+	return cnt, tx.Commit()
+}
+
+// 返回建表语句对应的表名及列信息
+func sqliteParseCreate(create string) (string, []*sqliteColumnInfo, error) {
+	if db, err := sql.Open("sqlite3", ":memory:"); nil == err {
+		//
+		defer db.Close()
+		//
+		if _, err := db.Exec(create); nil != err {
+			return "", nil, err
+		}
+		//
+		var name string
+		//
+		if err := db.QueryRow("SELECT tbl_name FROM sqlite_master WHERE type=='table' AND tbl_name!='sqlite_sequence';").Scan(&name); nil != err {
+			return "", nil, err
+		}
+		//
+		if columns, err := sqliteColumnInfos(db, name); nil == err {
+			if 0 < len(columns) {
+				return name, columns, nil
+			}
+			return "", nil, fmt.Errorf("table %s has no columns", name)
+		} else {
+			return "", nil, err
+		}
+	} else {
+		return "", nil, err
+	}
+}
+
+// 将JSON解码后的值按声明类型还原
+func sqliteJSONValue(decl string, value interface{}) (interface{}, error) {
+	// time.Time被编码为RFC3339
+	if v, ok := value.(string); ok {
+		switch sqliteTypeName(decl) {
+		case "timestamp", "datetime", "date":
+			if t, err := time.Parse(time.RFC3339Nano, v); nil == err {
+				return t, nil
+			}
+		}
+	}
+	//
+	return sqliteRawJSONValue(decl, value)
+}
+
+// 将JSON解码后的值按类型亲和性还原，文本原样写入
+func sqliteRawJSONValue(decl string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case json.Number:
+		switch sqliteAffinity(decl) {
+		case affinityInteger, affinityNumeric:
+			if n, err := v.Int64(); nil == err {
+				return n, nil
+			}
+			return v.Float64()
+		case affinityReal:
+			return v.Float64()
+		case affinityText:
+			return v.String(), nil
+		}
+		if n, err := v.Int64(); nil == err {
+			return n, nil
+		}
+		return v.Float64()
+	case map[string]interface{}:
+		// []byte被编码为{"$b64":"..."}，文本即使符合base64格式也原样写入
+		if data, ok := v[jsonBlobKey].(string); ok && 1 == len(v) {
+			return base64.StdEncoding.DecodeString(data)
+		}
+		return nil, fmt.Errorf("unexpected object value %v", v)
+	case string:
+		return v, nil
+	}
+	// nil及bool原样写入
+	return value, nil
+}
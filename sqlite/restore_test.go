@@ -0,0 +1,63 @@
+package sqlite
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 只写入与现有表相同的列，只有标记的值还原为BLOB，符合base64格式的文本不变
+func TestRestoreJSONColumns(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "restore")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	path := filepath.Join(dir, "dump.json")
+	//
+	if err := ioutil.WriteFile(path, []byte(`{"sql":"CREATE TABLE t (id INTEGER PRIMARY KEY, data, old TEXT)","count":2,"list":[[1,{"$b64":"AAEC"},"x"],[2,"AAEC","y"]]}`), 0644); nil != err {
+		t.Fatal(err)
+	}
+	//
+	db, err := sql.Open("sqlite3", ":memory:")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer db.Close()
+	//
+	db.SetMaxOpenConns(1)
+	//
+	if _, err := db.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, data);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if n, err := SQLiteRestoreJSON(db, path, ConflictFail); nil != err {
+		t.Fatal(err)
+	} else if 2 != n {
+		t.Fatalf("restored %d rows, expected 2", n)
+	}
+	//
+	var data []byte
+	var kind string
+	//
+	if err := db.QueryRow("SELECT data, typeof(data) FROM t WHERE 1 == id;").Scan(&data, &kind); nil != err {
+		t.Fatal(err)
+	} else if "blob" != kind || !bytes.Equal([]byte{0, 1, 2}, data) {
+		t.Fatalf("restored %s %v", kind, data)
+	}
+	//
+	if err := db.QueryRow("SELECT typeof(data) FROM t WHERE 2 == id;").Scan(&kind); nil != err {
+		t.Fatal(err)
+	} else if "text" != kind {
+		t.Fatalf("restored %s", kind)
+	}
+}
@@ -0,0 +1,512 @@
+package sqlite
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elitah/utils/logs"
+)
+
+const (
+	// 归档文件名中的时间格式
+	archiveTimeLayout = "20060102T150405Z"
+
+	// 归档文件后缀
+	// 只使用标准库的gzip，zstd需要引入第三方模块(如klauspost/compress)，暂不支持
+	archiveExt = ".gz"
+)
+
+// 保留策略，每个Every时长内保留一份归档，共保留最近Keep个时段
+// 例如{time.Hour, 24}与{24 * time.Hour, 7}表示一天内每小时保留一份，一周内每天保留一份
+type RetentionRule struct {
+	Every time.Duration
+	Keep  int
+}
+
+// 备份文件信息
+type SQLiteBackupInfo struct {
+	Path string `json:"path"`
+	// 从新到旧的序号，与Restored返回的代数一致
+	Generation int   `json:"generation"`
+	Archived   bool  `json:"archived"`
+	Encrypted  bool  `json:"encrypted"`
+	Size       int64 `json:"size"`
+	// 归档文件为归档时间，其余为修改时间
+	Time time.Time `json:"time"`
+	// 各表行数，只在深度检查时读取，Encrypted同样只在深度检查时判断
+	Tables map[string]int64 `json:"tables,omitempty"`
+	// 无法读取或校验失败的原因
+	Error string `json:"error,omitempty"`
+}
+
+// 每次备份成功后按保留策略生成gzip压缩的归档文件，文件名为name.{time}.ext.gz
+func WithBackupRetention(rules ...RetentionRule) Option {
+	var list []RetentionRule
+	//
+	for _, item := range rules {
+		if 0 < item.Every && 0 < item.Keep {
+			list = append(list, item)
+		}
+	}
+	//
+	if 0 < len(list) {
+		//
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Every < list[j].Every
+		})
+		//
+		return func(opts *options) {
+			opts.backup_retention = list
+		}
+	}
+	//
+	return nil
+}
+
+// 备份文件、轮换文件及归档文件占用的总空间上限，超出时先删除轮换文件再从最旧的归档开始删除，备份文件本身不会被删除
+func WithBackupBudget(size int64) Option {
+	if 0 < size {
+		return func(opts *options) {
+			opts.backup_budget = size
+		}
+	}
+	return nil
+}
+
+// 备份文件路径拆分为不含扩展名的部分及扩展名
+func (this *SQLiteDB) backupName() (string, string) {
+	ext := filepath.Ext(this.opts.backup_path)
+	//
+	return this.opts.backup_path[:len(this.opts.backup_path)-len(ext)], ext
+}
+
+// 归档文件，按从新到旧排列
+func (this *SQLiteDB) backupArchives() []string {
+	//
+	dir := filepath.Dir(this.opts.backup_path)
+	//
+	var list []string
+	//
+	if files, err := ioutil.ReadDir(dir); nil == err {
+		for _, item := range files {
+			if path := filepath.Join(dir, item.Name()); !item.IsDir() {
+				if _, ok := this.archiveTime(path); ok {
+					list = append(list, path)
+				}
+			}
+		}
+	}
+	// 时间格式定长，按名称排序即按时间排序
+	sort.Sort(sort.Reverse(sort.StringSlice(list)))
+	//
+	return list
+}
+
+func (this *SQLiteDB) archiveTime(path string) (time.Time, bool) {
+	//
+	basepath, ext := this.backupName()
+	//
+	prefix, suffix := filepath.Base(basepath)+".", ext+archiveExt
+	//
+	if name := filepath.Base(path); strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) && len(prefix)+len(suffix) <= len(name) {
+		if t, err := time.Parse(archiveTimeLayout, name[len(prefix):len(name)-len(suffix)]); nil == err {
+			return t, true
+		}
+	}
+	//
+	return time.Time{}, false
+}
+
+func sqliteIsArchive(path string) bool {
+	return strings.HasSuffix(path, archiveExt)
+}
+
+// 列出所有备份文件，顺序与恢复时的尝试顺序一致，期间持有备份锁，备份文件不会被轮换
+// 默认只校验备份文件的校验和，deep为true时载入每个备份进行完整性检查并统计各表行数，备份较大时耗时较长
+func (this *SQLiteDB) ListBackups(deep ...bool) ([]*SQLiteBackupInfo, error) {
+	if "" == this.opts.backup_path {
+		return nil, fmt.Errorf("no backup file path be provided")
+	}
+	//
+	if err := this.lockBackup(context.Background()); nil != err {
+		return nil, err
+	}
+	//
+	defer this.unlockBackup()
+	//
+	var result []*SQLiteBackupInfo
+	//
+	for i, path := range append(this.backupGenerations(), this.backupArchives()...) {
+		//
+		fi, err := os.Stat(path)
+		//
+		if nil != err {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		//
+		info := &SQLiteBackupInfo{
+			Path:       path,
+			Generation: i,
+			Archived:   sqliteIsArchive(path),
+			Size:       fi.Size(),
+			Time:       fi.ModTime(),
+		}
+		//
+		if t, ok := this.archiveTime(path); ok && info.Archived {
+			info.Time = t
+		}
+		//
+		if 0 < info.Size {
+			if 0 < len(deep) && deep[0] {
+				if err := this.inspectBackup(info); nil != err {
+					info.Error = err.Error()
+				}
+			} else if !info.Archived {
+				if err := sqliteVerifyChecksum(path); nil != err {
+					info.Error = err.Error()
+				}
+			}
+		}
+		//
+		result = append(result, info)
+	}
+	//
+	return result, nil
+}
+
+func (this *SQLiteDB) inspectBackup(info *SQLiteBackupInfo) error {
+	//
+	if !info.Archived {
+		if err := sqliteVerifyChecksum(info.Path); nil != err {
+			return err
+		}
+	}
+	//
+	plain, cleanup, encrypted, err := this.openBackup(info.Path)
+	//
+	info.Encrypted = encrypted
+	//
+	if nil != err {
+		return err
+	}
+	//
+	defer cleanup()
+	//
+	if err := sqliteIntegrityCheck(plain); nil != err {
+		return err
+	}
+	//
+	if db, err := sql.Open("sqlite3", plain); nil == err {
+		//
+		defer db.Close()
+		//
+		info.Tables, err = sqliteTableCounts(db)
+		//
+		return err
+	} else {
+		return err
+	}
+}
+
+func sqliteTableCounts(db *sql.DB) (map[string]int64, error) {
+	//
+	var tables []string
+	//
+	if rows, err := db.Query("SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%';"); nil == err {
+		//
+		for rows.Next() {
+			//
+			var name string
+			//
+			if err := rows.Scan(&name); nil != err {
+				rows.Close()
+				return nil, err
+			}
+			//
+			tables = append(tables, name)
+		}
+		//
+		rows.Close()
+	} else {
+		return nil, err
+	}
+	//
+	result := make(map[string]int64, len(tables))
+	//
+	for _, name := range tables {
+		//
+		var cnt int64
+		//
+		if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s;", sqliteQuote(name))).Scan(&cnt); nil != err {
+			return nil, err
+		}
+		//
+		result[name] = cnt
+	}
+	//
+	return result, nil
+}
+
+// 返回可直接打开的明文数据源，支持归档文件，归档文件解压后载入独立的内存数据库
+func (this *SQLiteDB) openBackup(path string) (string, func(), bool, error) {
+	//
+	if !sqliteIsArchive(path) {
+		return this.openFile(path)
+	}
+	//
+	data, encrypted, err := this.readArchive(path)
+	//
+	if nil != err {
+		return "", func() {}, encrypted, err
+	}
+	//
+	plain, cleanup, err := this.loadMemory(data)
+	//
+	if nil != err {
+		return "", func() {}, encrypted, err
+	}
+	//
+	return plain, cleanup, encrypted, nil
+}
+
+// 读取归档文件并解压
+func (this *SQLiteDB) readArchive(path string) ([]byte, bool, error) {
+	//
+	data, err := ioutil.ReadFile(path)
+	//
+	if nil != err {
+		return nil, false, err
+	}
+	//
+	encrypted := bytes.HasPrefix(data, []byte(cryptMagic))
+	//
+	if encrypted {
+		if data, _, err = this.unseal(data[len(cryptMagic):]); nil != err {
+			return nil, true, err
+		}
+	}
+	//
+	if r, err := gzip.NewReader(bytes.NewReader(data)); nil == err {
+		if data, err = ioutil.ReadAll(r); nil != err {
+			return nil, encrypted, fmt.Errorf("%w, %v", EBackupCorrupt, err)
+		}
+	} else {
+		return nil, encrypted, fmt.Errorf("%w, %v", EBackupCorrupt, err)
+	}
+	//
+	return data, encrypted, nil
+}
+
+// 压缩备份文件生成归档，启用加密时先压缩再加密
+func (this *SQLiteDB) writeArchive(now time.Time) error {
+	//
+	basepath, ext := this.backupName()
+	//
+	path := fmt.Sprintf("%s.%s%s%s", basepath, now.UTC().Format(archiveTimeLayout), ext, archiveExt)
+	//
+	tmp := path + ".tmp"
+	//
+	var err error
+	//
+	if this.encrypted() {
+		err = this.writeSealedArchive(tmp)
+	} else {
+		err = sqliteGzipFile(this.opts.backup_path, tmp)
+	}
+	//
+	if nil == err {
+		return os.Rename(tmp, path)
+	} else {
+		os.Remove(tmp)
+		return err
+	}
+}
+
+// 加密需要完整的数据，在内存中解密、压缩后再加密，不写入明文文件
+func (this *SQLiteDB) writeSealedArchive(dst string) error {
+	//
+	data, _, err := this.readPlain(this.opts.backup_path)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	var buf bytes.Buffer
+	//
+	w := gzip.NewWriter(&buf)
+	//
+	if _, err := w.Write(data); nil != err {
+		return err
+	}
+	//
+	if err := w.Close(); nil != err {
+		return err
+	}
+	//
+	if result, err := this.seal(buf.Bytes()); nil == err {
+		return ioutil.WriteFile(dst, append([]byte(cryptMagic), result...), 0600)
+	} else {
+		return err
+	}
+}
+
+// 未加密时直接从文件流式压缩，不把整个数据库读入内存
+func sqliteGzipFile(src, dst string) error {
+	//
+	r, err := os.Open(src)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	defer r.Close()
+	//
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	w := gzip.NewWriter(f)
+	//
+	if _, err = io.Copy(w, r); nil == err {
+		err = w.Close()
+	}
+	//
+	if _err := f.Close(); nil == err {
+		err = _err
+	}
+	//
+	return err
+}
+
+// 备份成功后生成归档、清理过期归档并检查空间占用
+func (this *SQLiteDB) retain() {
+	//
+	now := time.Now()
+	//
+	if rules := this.opts.backup_retention; 0 < len(rules) {
+		//
+		archives := this.backupArchives()
+		// 最短时段内已有归档时不再生成，减少闪存写入
+		create := true
+		//
+		if 0 < len(archives) {
+			if t, ok := this.archiveTime(archives[0]); ok {
+				create = !now.UTC().Truncate(rules[0].Every).Equal(t.Truncate(rules[0].Every))
+			}
+		}
+		//
+		if create {
+			if err := this.writeArchive(now); nil != err {
+				logs.Error("unable write archive, %v", err)
+			}
+			//
+			archives = this.backupArchives()
+		}
+		//
+		var times []time.Time
+		//
+		for _, item := range archives {
+			t, _ := this.archiveTime(item)
+			times = append(times, t)
+		}
+		//
+		keep := sqliteRetain(times, rules, now)
+		//
+		for i, item := range archives {
+			if !keep[i] {
+				os.Remove(item)
+			}
+		}
+	}
+	//
+	if 0 < this.opts.backup_budget {
+		this.enforceBudget()
+	}
+}
+
+// times按从新到旧排列，返回需要保留的序号
+func sqliteRetain(times []time.Time, rules []RetentionRule, now time.Time) map[int]bool {
+	//
+	keep := make(map[int]bool)
+	// 最新的归档总是保留
+	if 0 < len(times) {
+		keep[0] = true
+	}
+	//
+	for _, rule := range rules {
+		//
+		current := now.UTC().Truncate(rule.Every)
+		//
+		// time.Time作为键时会比较时区，使用纳秒时间戳
+		seen := make(map[int64]bool)
+		//
+		for i, t := range times {
+			//
+			slot := t.Truncate(rule.Every)
+			//
+			if current.Sub(slot) >= time.Duration(rule.Keep)*rule.Every {
+				continue
+			}
+			// 从新到旧遍历，每个时段第一个即最新的一份
+			if !seen[slot.UnixNano()] {
+				seen[slot.UnixNano()] = true
+				keep[i] = true
+			}
+		}
+	}
+	//
+	return keep
+}
+
+// 超出空间上限时先删除轮换文件，再从最旧的归档开始删除，长期保留的归档比短期的轮换文件更难恢复
+func (this *SQLiteDB) enforceBudget() {
+	//
+	generations := this.backupGenerations()
+	archives := this.backupArchives()
+	// 从后向前删除，备份文件本身排在最前，轮换文件排在归档之后
+	list := append(append([]string{generations[0]}, archives...), generations[1:]...)
+	//
+	sizes := make([]int64, len(list))
+	//
+	var total int64
+	//
+	for i, path := range list {
+		for _, item := range []string{path, path + checksumExt} {
+			if info, err := os.Stat(item); nil == err {
+				sizes[i] += info.Size()
+			}
+		}
+		total += sizes[i]
+	}
+	//
+	for i := len(list) - 1; 0 < i && this.opts.backup_budget < total; i-- {
+		if 0 < sizes[i] {
+			//
+			logs.Warn("备份占用空间%d超出上限%d，删除%s", total, this.opts.backup_budget, list[i])
+			//
+			os.Remove(list[i])
+			os.Remove(list[i] + checksumExt)
+			//
+			total -= sizes[i]
+		}
+	}
+	//
+	if this.opts.backup_budget < total {
+		logs.Warn("备份文件本身已超出空间上限: %d > %d", total, this.opts.backup_budget)
+	}
+}
@@ -0,0 +1,157 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 超出空间上限时先删除轮换文件，保留长期归档
+func TestBudgetDropsRotatedFirst(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "retention")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	db := NewSQLiteDB(WithName(t.Name()), WithBackup(filepath.Join(dir, "test.db"), 2), WithBackupBudget(350))
+	//
+	for _, name := range []string{"test.db", "test.000.db", "test.001.db", "test.20240101T000000Z.db.gz", "test.20240102T000000Z.db.gz"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, 100), 0644); nil != err {
+			t.Fatal(err)
+		}
+	}
+	//
+	db.enforceBudget()
+	//
+	for name, exists := range map[string]bool{
+		"test.db":                     true,
+		"test.000.db":                 false,
+		"test.001.db":                 false,
+		"test.20240101T000000Z.db.gz": true,
+		"test.20240102T000000Z.db.gz": true,
+	} {
+		if _, err := os.Stat(filepath.Join(dir, name)); exists != (nil == err) {
+			t.Fatalf("%s exists %v, expected %v", name, nil == err, exists)
+		}
+	}
+}
+
+// 不同时区表示的同一时段只保留一份
+func TestRetainTimeZone(t *testing.T) {
+	//
+	now := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+	//
+	keep := sqliteRetain([]time.Time{
+		now.Add(-time.Minute),
+		now.Add(-2 * time.Minute).In(time.FixedZone("X", 3600)),
+	}, []RetentionRule{{time.Hour, 24}}, now)
+	//
+	if !keep[0] || keep[1] {
+		t.Fatalf("keep %v", keep)
+	}
+}
+
+// 未加密的归档直接从文件压缩，解压后与备份文件相同
+func TestArchiveRoundTrip(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "retention")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	backup := filepath.Join(dir, "test.db")
+	//
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	//
+	if err := ioutil.WriteFile(backup, data, 0644); nil != err {
+		t.Fatal(err)
+	}
+	//
+	db := NewSQLiteDB(WithName(t.Name()), WithBackup(backup))
+	//
+	if err := db.writeArchive(time.Now()); nil != err {
+		t.Fatal(err)
+	}
+	//
+	archives := db.backupArchives()
+	//
+	if 1 != len(archives) {
+		t.Fatalf("archives %v", archives)
+	}
+	//
+	if result, encrypted, err := db.readArchive(archives[0]); nil != err {
+		t.Fatal(err)
+	} else if encrypted || !bytes.Equal(data, result) {
+		t.Fatal("archive content mismatch")
+	}
+}
+
+// 默认只校验校验和，深度检查时统计各表行数，备份进行中时等待
+func TestListBackups(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "retention")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	db := NewSQLiteDB(WithName(testName(t)), WithBackup(filepath.Join(dir, "test.db")))
+	//
+	conn, err := db.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer db.Close()
+	//
+	if _, err := conn.Exec("CREATE TABLE t (v); INSERT INTO t VALUES (1), (2);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if err := db.Backup(); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if list, err := db.ListBackups(); nil != err {
+		t.Fatal(err)
+	} else if 1 != len(list) || "" != list[0].Error || nil != list[0].Tables {
+		t.Fatalf("unexpected list %+v", list[0])
+	}
+	//
+	if err := db.lockBackup(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	//
+	result := make(chan []*SQLiteBackupInfo, 1)
+	//
+	go func() {
+		list, _ := db.ListBackups(true)
+		result <- list
+	}()
+	//
+	select {
+	case <-result:
+		t.Fatal("listed during backup")
+	case <-time.After(50 * time.Millisecond):
+	}
+	//
+	db.unlockBackup()
+	//
+	if list := <-result; 1 != len(list) || "" != list[0].Error || 2 != list[0].Tables["t"] {
+		t.Fatalf("unexpected list %+v", list)
+	}
+}
@@ -0,0 +1,250 @@
+package sqlite
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elitah/utils/logs"
+)
+
+// 防抖延迟，数据库最后一次变化后等待该时长再备份
+func WithBackupDelay(d time.Duration) Option {
+	if 0 < d {
+		return func(opts *options) {
+			opts.schedule_delay = d
+		}
+	}
+	return nil
+}
+
+// 最大延迟，从第一次变化开始最多等待该时长就强制备份，未设置时等于防抖延迟
+func WithBackupMaxDelay(d time.Duration) Option {
+	if 0 < d {
+		return func(opts *options) {
+			opts.schedule_max_delay = d
+		}
+	}
+	return nil
+}
+
+// 两次备份之间的最小间隔
+func WithBackupInterval(d time.Duration) Option {
+	if 0 < d {
+		return func(opts *options) {
+			opts.schedule_interval = d
+		}
+	}
+	return nil
+}
+
+// 固定时间备份，格式为"分 时 日 月 周"，另支持@hourly、@daily、@weekly、@monthly及@every <duration>
+// 设置后仅在计划时间且数据库有变化时备份，格式错误或永远不会触发时StartBackup返回该错误
+func WithBackupSchedule(spec string) Option {
+	if s, err := parseSchedule(spec); nil == err {
+		return func(opts *options) {
+			opts.schedule = s
+			opts.schedule_err = nil
+		}
+	} else {
+		//
+		logs.Error(err)
+		//
+		return func(opts *options) {
+			opts.schedule = nil
+			opts.schedule_err = err
+		}
+	}
+}
+
+// 检查WithBackupSchedule的格式
+func ParseSchedule(spec string) error {
+	_, err := parseSchedule(spec)
+	return err
+}
+
+// 每次自动备份后回调，参数为发生变化的表、备份耗时及结果
+func WithBackupNotify(fn func([]string, time.Duration, error)) Option {
+	if nil != fn {
+		return func(opts *options) {
+			opts.schedule_notify = fn
+		}
+	}
+	return nil
+}
+
+type sqliteSchedule interface {
+	Next(time.Time) time.Time
+}
+
+type sqliteEverySchedule time.Duration
+
+func (this sqliteEverySchedule) Next(t time.Time) time.Time {
+	return t.Truncate(time.Duration(this)).Add(time.Duration(this))
+}
+
+type sqliteCronSchedule struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+
+	// 日与周同时被限定时满足其一即可，以*开头(含*/n)的字段不算限定
+	either bool
+}
+
+func (this *sqliteCronSchedule) matchDay(t time.Time) bool {
+	//
+	dom := 0 != this.dom&(1<<uint(t.Day()))
+	dow := 0 != this.dow&(1<<uint(t.Weekday()))
+	//
+	if this.either {
+		return dom || dow
+	}
+	//
+	return dom && dow
+}
+
+func (this *sqliteCronSchedule) Next(t time.Time) time.Time {
+	//
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// 最多向后查找5年
+	limit := t.AddDate(5, 0, 0)
+	//
+	for t.Before(limit) {
+		if 0 == this.month&(1<<uint(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !this.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if 0 == this.hour&(1<<uint(t.Hour())) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if 0 == this.minute&(1<<uint(t.Minute())) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	//
+	return time.Time{}
+}
+
+func parseSchedule(spec string) (sqliteSchedule, error) {
+	//
+	spec = strings.TrimSpace(spec)
+	//
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	default:
+		if strings.HasPrefix(spec, "@every ") {
+			if d, err := time.ParseDuration(strings.TrimSpace(spec[7:])); nil == err {
+				if time.Second <= d {
+					return sqliteEverySchedule(d), nil
+				}
+				return nil, fmt.Errorf("schedule interval too short: %v", d)
+			} else {
+				return nil, err
+			}
+		}
+	}
+	//
+	fields := strings.Fields(spec)
+	//
+	if 5 != len(fields) {
+		return nil, fmt.Errorf("invalid schedule: %s", spec)
+	}
+	//
+	var err error
+	//
+	s := &sqliteCronSchedule{}
+	//
+	for i, item := range []struct {
+		result   *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 6},
+	} {
+		if *item.result, err = parseScheduleField(fields[i], item.min, item.max); nil != err {
+			return nil, fmt.Errorf("invalid schedule: %s, %w", spec, err)
+		}
+	}
+	//
+	s.either = !strings.HasPrefix(fields[2], "*") && !strings.HasPrefix(fields[4], "*")
+	// 如"0 0 30 2 *"，Next向后查找5年，覆盖2月29日的4年周期
+	if s.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule never fires: %s", spec)
+	}
+	//
+	return s, nil
+}
+
+func parseScheduleField(field string, min, max int) (uint64, error) {
+	var result uint64
+	//
+	for _, part := range strings.Split(field, ",") {
+		//
+		step := 1
+		//
+		if i := strings.IndexByte(part, '/'); 0 <= i {
+			if n, err := strconv.Atoi(part[i+1:]); nil == err && 0 < n {
+				step = n
+			} else {
+				return 0, fmt.Errorf("invalid step: %s", part)
+			}
+			part = part[:i]
+		}
+		//
+		start, end := min, max
+		//
+		if "*" != part {
+			if i := strings.IndexByte(part, '-'); 0 <= i {
+				if n, err := strconv.Atoi(part[:i]); nil == err {
+					start = n
+				} else {
+					return 0, err
+				}
+				if n, err := strconv.Atoi(part[i+1:]); nil == err {
+					end = n
+				} else {
+					return 0, err
+				}
+			} else if n, err := strconv.Atoi(part); nil == err {
+				start = n
+				// 单个数值带步长时表示从该值开始
+				if 1 == step {
+					end = n
+				}
+			} else {
+				return 0, err
+			}
+		}
+		//
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("out of range: %s", part)
+		}
+		//
+		for i := start; end >= i; i += step {
+			result |= 1 << uint(i)
+		}
+	}
+	//
+	return result, nil
+}
@@ -0,0 +1,55 @@
+package sqlite
+
+import (
+	"testing"
+	"time"
+)
+
+// 日与周都被限定时满足其一即可，以*开头的字段不算限定
+func TestScheduleDayRule(t *testing.T) {
+	//
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	//
+	for _, item := range []struct {
+		spec     string
+		expected time.Time
+	}{
+		// 2024-01-01是周一
+		{"0 0 1 * 3", time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 */2 * 1", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 15 * */3", time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 3", time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+	} {
+		if s, err := parseSchedule(item.spec); nil != err {
+			t.Fatal(err)
+		} else if next := s.Next(start); !next.Equal(item.expected) {
+			t.Fatalf("%s next %v, expected %v", item.spec, next, item.expected)
+		}
+	}
+}
+
+func TestScheduleError(t *testing.T) {
+	//
+	for _, spec := range []string{"0 0 32 * *", "0 0 30 2 *", "0 0 31 4,6 *"} {
+		if err := ParseSchedule(spec); nil == err {
+			t.Fatalf("invalid schedule %s accepted", spec)
+		}
+	}
+	// 2月29日每4年一次
+	if err := ParseSchedule("0 0 29 2 *"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	db := NewSQLiteDB(WithName(testName(t)), WithBackupSchedule("0 0 30 2 *"))
+	//
+	defer db.Close()
+	//
+	if _, err := db.GetConn(); nil != err {
+		t.Fatal(err)
+	}
+	//
+	// 不启动自动备份时同样返回错误
+	if _, err := db.StartBackup(false); nil == err {
+		t.Fatal("invalid schedule accepted")
+	}
+}
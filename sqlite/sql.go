@@ -2,11 +2,12 @@ package sqlite
 
 import (
 	"fmt"
+	"strings"
 )
 
 func SQLiteCount(db *SQLiteDB, tbl_name string) (int64, error) {
 	if conn, err := db.GetConn(true); nil == err {
-		if row := conn.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", tbl_name)); nil != row {
+		if row := conn.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", sqliteQuoteTable(tbl_name))); nil != row {
 			var cnt int64
 			if err := row.Scan(&cnt); nil == err {
 				return cnt, nil
@@ -20,3 +21,24 @@ func SQLiteCount(db *SQLiteDB, tbl_name string) (int64, error) {
 		return 0, err
 	}
 }
+
+func sqliteQuote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func sqliteQuoteList(names []string) string {
+	var sb strings.Builder
+	//
+	for i, name := range names {
+		if 0 < i {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(sqliteQuote(name))
+	}
+	//
+	return sb.String()
+}
+
+func sqliteQuoteString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -1,10 +1,13 @@
 package sqlite
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -30,6 +33,31 @@ type options struct {
 	backup_step  int
 	backup_delay int
 
+	backup_incremental bool
+
+	backup_retention []RetentionRule
+	backup_budget    int64
+
+	backup_progress func(int, int)
+
+	close_timeout time.Duration
+
+	journal_path string
+
+	replica_secret []byte
+
+	schedule           sqliteSchedule
+	schedule_err       error
+	schedule_delay     time.Duration
+	schedule_max_delay time.Duration
+	schedule_interval  time.Duration
+	schedule_notify    func([]string, time.Duration, error)
+
+	dsn string
+
+	crypt_keys []string
+	crypt_err  error
+
 	dbchan_master string
 	dbchan_backup string
 }
@@ -62,21 +90,97 @@ func WithBackup(path string, args ...int) Option {
 	return nil
 }
 
+// 备份过程中每步完成后回调，参数为剩余页数及总页数
+func WithBackupProgress(fn func(remaining, total int)) Option {
+	if nil != fn {
+		return func(opts *options) {
+			opts.backup_progress = fn
+		}
+	}
+
+	return nil
+}
+
+// 关闭数据库时最终备份的最长时间，超时后放弃备份，保留上一次的备份文件
+func WithCloseTimeout(d time.Duration) Option {
+	if 0 < d {
+		return func(opts *options) {
+			opts.close_timeout = d
+		}
+	}
+
+	return nil
+}
+
+// 使用独立的命名内存数据库，同一进程内名称相同的实例共享数据
+func WithName(name string) Option {
+	if "" != name {
+		return func(opts *options) {
+			opts.dsn = fmt.Sprintf("file:%s?mode=memory&cache=shared", url.PathEscape(name))
+		}
+	}
+
+	return nil
+}
+
+// 使用指定的数据源，如文件数据库
+func WithDSN(dsn string) Option {
+	if "" != dsn {
+		return func(opts *options) {
+			opts.dsn = dsn
+		}
+	}
+
+	return nil
+}
+
 type SQLiteDB struct {
+	// 最近一次全量备份时的表结构版本
+	schema int64
+
 	sync.Mutex
 
 	store sqliteRawConnStore
 
 	conn *sql.DB
 
+	journal *sqliteJournal
+
+	migrations []*sqliteMigration
+
+	reports []*SQLiteSyncReport
+
+	// 备份及快照等直接使用主连接的操作互斥，等待时可以取消
+	backup_lock chan struct{}
+
+	// 正在进行的全量备份的上下文，仅在持有备份锁时由备份驱动读取
+	backup_ctx context.Context
+
+	// 自动备份在关闭时取消
+	loop_ctx    context.Context
+	loop_cancel context.CancelFunc
+
+	stats sqliteStats
+
+	// 最近一次恢复使用的备份文件及其代数
+	restored      int
+	restored_path string
+
 	opts options
 }
 
 func NewSQLiteDB(opts ...Option) *SQLiteDB {
 	r := &SQLiteDB{
+		schema:      -1,
+		restored:    -1,
+		backup_lock: make(chan struct{}, 1),
 		opts: options{
 			backup_step:  1024, // 单步备份长度
 			backup_delay: 10,   // 单步备份被打断后延迟时间（毫秒）
+			// 默认使用进程内共享的内存数据库
+			dsn: "file::memory:?mode=memory&cache=shared",
+			// 数据库变化后15秒备份
+			schedule_delay: 15 * time.Second,
 		},
 	}
 
@@ -86,8 +190,21 @@ func NewSQLiteDB(opts ...Option) *SQLiteDB {
 		}
 	}
 
+	if r.opts.schedule_max_delay < r.opts.schedule_delay {
+		r.opts.schedule_max_delay = r.opts.schedule_delay
+	}
+
 	r.opts.dbchan_master = fmt.Sprintf("sqlite3_master_%p", r)
 
+	r.loop_ctx, r.loop_cancel = context.WithCancel(context.Background())
+
+	r.store.stats = &r.stats
+
+	// 增量备份需要记录变化的行
+	if r.opts.backup_incremental {
+		r.store.EnableTrack()
+	}
+
 	// 注册sqlite主驱动
 	sql.Register(r.opts.dbchan_master, &sqlite3.SQLiteDriver{
 		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
@@ -104,7 +221,14 @@ func NewSQLiteDB(opts ...Option) *SQLiteDB {
 		sql.Register(r.opts.dbchan_backup, &sqlite3.SQLiteDriver{
 			ConnectHook: func(slave *sqlite3.SQLiteConn) error {
 				if master := r.store.Get(); nil != master {
-					return SQLiteBackup(master, slave, r.opts.backup_step, r.opts.backup_delay)
+					//
+					ctx := r.backup_ctx
+					//
+					if nil == ctx {
+						ctx = context.Background()
+					}
+					//
+					return SQLiteBackupContext(ctx, master, slave, r.opts.backup_step, r.opts.backup_delay, r.opts.backup_progress)
 				} else {
 					return fmt.Errorf("no master connection be found")
 				}
@@ -122,7 +246,7 @@ func (this *SQLiteDB) GetConn(flags ...bool) (conn *sql.DB, err error) {
 		if nil != this.conn {
 			conn = this.conn
 		} else {
-			if conn, err = sql.Open(this.opts.dbchan_master, "file::memory:?mode=memory&cache=shared"); nil == err {
+			if conn, err = sql.Open(this.opts.dbchan_master, this.opts.dsn); nil == err {
 				//
 				conn.SetMaxOpenConns(1)
 				//
@@ -145,98 +269,318 @@ func (this *SQLiteDB) GetConn(flags ...bool) (conn *sql.DB, err error) {
 }
 
 func (this *SQLiteDB) StartBackup(auto bool) (int64, error) {
+	// 密钥无效时不能回退为明文备份
+	if nil != this.opts.crypt_err {
+		return 0, this.opts.crypt_err
+	}
+	// 计划格式错误时不恢复也不启动自动备份
+	if nil != this.opts.schedule_err {
+		return 0, this.opts.schedule_err
+	}
+	//
 	if "" != this.opts.backup_path {
-		// 检查文件是否存在
-		if info, err := os.Stat(this.opts.backup_path); nil == err {
-			if 0 == info.Size() {
-				return 0, nil
-			}
-		} else {
+		var n int64
+		// 上次异常退出时可能残留明文临时文件
+		if this.encrypted() {
+			this.sweepPlain()
+		}
+		// 从新到旧选择校验通过的备份文件
+		path, generation, err := this.selectBackup()
+		// 启用日志时，即使备份文件不存在也需要回放日志
+		if nil != err && !(os.IsNotExist(err) && "" != this.opts.journal_path) {
 			return 0, err
 		}
-		// 开始同步
-		if master, err := this.GetConn(true); nil == err {
-			if slave, err := sql.Open("sqlite3", this.opts.backup_path); nil == err {
-				if n, err := SQLiteSync(master, slave, filepath.Dir(this.opts.backup_path)); nil == err {
-					// 如果开启了自动备份
-					if auto {
-						// 检查自动备份是否启用
-						if atomic.CompareAndSwapUint32(&this.opts.flag_groups[PlanAutoBackup], 0x0, 0x1) {
-							go func() {
-								// 缓冲
-								var sb strings.Builder
-								// 计时
-								var unix_trigger int64
-								// 监测通道
-								ch := make(chan string, 1)
-								// 表变化监测模块
-								tableList := make(map[string]bool)
-								// 注册监听
-								this.store.RegisterNotice(ch)
-								// 3秒循环
-								ticker := time.NewTicker(3 * time.Second)
-								// 循环监测数据库变动
-								for {
-									select {
-									case name, ok := <-ch:
-										if ok {
-											// 标记
-											tableList[name] = true
-											// 倒计时15秒
-											if 0 == unix_trigger {
-												t := time.Now().Add(15 * time.Second)
-												//
-												unix_trigger = t.Unix()
-												//
-												logs.Info("数据库出现变化，15秒后(%s)开始备份", t.Format("2006-01-02 15:04:05"))
-											}
-										} else {
-											return
-										}
-									case <-ticker.C:
-										// 如果倒计时已结束
-										if 0 != unix_trigger && unix_trigger < time.Now().Unix() {
-											// 复位计时
-											unix_trigger = 0
-											// 清空缓冲
-											sb.Reset()
-											// 检查标记
-											for key, value := range tableList {
-												if value {
-													// 标点符号
-													if 0 < sb.Len() {
-														sb.WriteRune(',')
-													}
-													// 表名
-													sb.WriteString(key)
-													// 清除标记
-													tableList[key] = false
-												}
-											}
-											// 信息输出
-											logs.Info("开始备份数据库，发生改变的表为: %s", sb.String())
-											// 开始备份
-											if err := this.Backup(); nil != err {
-												logs.Error(err)
-											}
-										}
-									}
-								}
-							}()
-						}
+		//
+		if source := path; "" != path {
+			// 归档文件解压到内存，迁移及恢复均使用解压后的数据库，不修改归档文件
+			if sqliteIsArchive(path) {
+				//
+				plain, cleanup, _, err := this.openBackup(path)
+				//
+				if nil != err {
+					return 0, err
+				}
+				//
+				defer cleanup()
+				//
+				if version := this.SchemaVersion(); 0 < version {
+					if _, err := this.migrateDB(plain, version); nil != err {
+						return 0, fmt.Errorf("unable migrate database, %w", err)
+					}
+				}
+				//
+				if n, err = this.restoreFrom(plain); nil != err {
+					return 0, err
+				}
+			} else {
+				// 恢复前先将备份文件迁移到最新版本
+				if version := this.SchemaVersion(); 0 < version {
+					if err := this.migrateFile(path, version); nil != err {
+						return 0, fmt.Errorf("unable migrate database, %w", err)
 					}
+				}
+				// 从备份文件恢复
+				if n, err = this.restore(path); nil != err {
+					return 0, err
+				}
+			}
+			//
+			if 0 < generation {
+				logs.Warn("最新的备份文件不可用，已从第%d代备份%s恢复", generation, source)
+			}
+			//
+			this.Lock()
+			//
+			this.restored = generation
+			this.restored_path = source
+			//
+			this.Unlock()
+		}
+		//
+		if err := this.markSchemaVersion(); nil != err {
+			return n, err
+		}
+		// 回放日志并开始记录
+		if "" != this.opts.journal_path {
+			if _n, err := this.startJournal(); nil == err {
+				n += _n
+			} else {
+				return n, err
+			}
+		}
+		// 如果开启了自动备份
+		if auto {
+			// 检查自动备份是否启用
+			if atomic.CompareAndSwapUint32(&this.opts.flag_groups[PlanAutoBackup], 0x0, 0x1) {
+				go this.loopBackup()
+			}
+		}
+		return n, nil
+	}
+	return 0, nil
+}
+
+func (this *SQLiteDB) restore(backup string) (int64, error) {
+	// 检查文件是否存在
+	if info, err := os.Stat(backup); nil == err {
+		if 0 == info.Size() {
+			return 0, nil
+		}
+	} else {
+		return 0, err
+	}
+	// 加密的备份需要先解密
+	path, cleanup, _, err := this.openFile(backup)
+	//
+	if nil != err {
+		return 0, err
+	}
+	//
+	defer cleanup()
+	//
+	return this.restoreFrom(path)
+}
+
+// 从可直接打开的数据源恢复
+func (this *SQLiteDB) restoreFrom(path string) (int64, error) {
+	// 开始同步
+	if master, err := this.GetConn(true); nil == err {
+		if slave, err := sql.Open("sqlite3", path); nil == err {
+			//
+			defer slave.Close()
+			//
+			if n, reports, err := SQLiteSyncWithReport(master, slave, filepath.Dir(this.opts.backup_path)); nil == err {
+				//
+				for _, item := range reports {
+					if 0 < len(item.Dropped) || 0 < len(item.Defaulted) || 0 < item.Failed || "" != item.Dump {
+						logs.Warn(item.String())
+					}
+				}
+				//
+				this.Lock()
+				//
+				this.reports = reports
+				//
+				this.Unlock()
+				//
+				return n, nil
+			} else {
+				return 0, fmt.Errorf("unable sync database, %w", err)
+			}
+		} else {
+			return 0, fmt.Errorf("unable open database, %w", err)
+		}
+	} else {
+		return 0, fmt.Errorf("unable get database connection, %w", err)
+	}
+}
+
+// 最近一次StartBackup恢复数据时各表的同步结果
+func (this *SQLiteDB) SyncReport() []*SQLiteSyncReport {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.reports
+}
+
+func (this *SQLiteDB) startJournal() (int64, error) {
+	if master, err := this.GetConn(true); nil == err {
+		//
+		var seal, unseal func([]byte) ([]byte, error)
+		//
+		if this.encrypted() {
+			seal, unseal = this.seal, this.journalUnseal()
+		}
+		// 先回放上次退出前未备份的变化
+		if n, err := sqliteReplayJournal(master, this.opts.journal_path, unseal); nil == err {
+			//
+			if 0 < n {
+				logs.Warn("日志回放完成，回放条数为%d", n)
+			}
+			//
+			if j, err := openJournal(this.opts.journal_path, master, seal, this.installJournalTriggers); nil == err {
+				//
+				this.Lock()
+				//
+				if nil != this.journal {
+					this.Unlock()
+					j.Close()
 					return n, nil
-				} else {
-					return 0, fmt.Errorf("unable sync database, %w", err)
 				}
+				//
+				this.journal = j
+				//
+				this.Unlock()
+				//
+				this.store.SetJournal(j)
+				// 之后的变化在提交前同步写入日志
+				if err := this.installJournalTriggers(master); nil != err {
+					return n, fmt.Errorf("unable install journal triggers, %w", err)
+				}
+				//
+				return n, nil
 			} else {
-				return 0, fmt.Errorf("unable open database, %w", err)
+				return n, fmt.Errorf("unable open journal, %w", err)
 			}
 		} else {
-			return 0, fmt.Errorf("unable get database connection, %w", err)
+			return 0, fmt.Errorf("unable replay journal, %w", err)
+		}
+	} else {
+		return 0, fmt.Errorf("unable get database connection, %w", err)
+	}
+}
+
+func (this *SQLiteDB) loopBackup() {
+	// 下一次备份时间
+	var trigger time.Time
+	// 第一次变化时间
+	var first time.Time
+	// 上一次备份时间
+	var last time.Time
+	// 监测通道
+	ch := make(chan string, 64)
+	// 表变化监测模块
+	tableList := make(map[string]bool)
+	// 注册监听
+	this.store.RegisterNotice(ch)
+	// 计时器
+	timer := time.NewTimer(time.Hour)
+	//
+	timer.Stop()
+	// 循环监测数据库变动
+	for {
+		select {
+		case name, ok := <-ch:
+			if ok {
+				//
+				now := time.Now()
+				// 标记
+				tableList[name] = true
+				//
+				if first.IsZero() {
+					first = now
+				}
+				//
+				var due time.Time
+				//
+				if nil != this.opts.schedule {
+					// 固定计划只需计算一次
+					if !trigger.IsZero() {
+						continue
+					}
+					//
+					if due = this.opts.schedule.Next(now); due.IsZero() {
+						continue
+					}
+				} else {
+					// 防抖
+					due = now.Add(this.opts.schedule_delay)
+					// 不超过最大延迟
+					if limit := first.Add(this.opts.schedule_max_delay); due.After(limit) {
+						due = limit
+					}
+				}
+				// 保证最小间隔
+				if !last.IsZero() {
+					if limit := last.Add(this.opts.schedule_interval); due.Before(limit) {
+						due = limit
+					}
+				}
+				//
+				if due.Equal(trigger) {
+					continue
+				}
+				//
+				if trigger.IsZero() && nil == this.opts.schedule_notify {
+					logs.Info("数据库出现变化，%s开始备份", due.Format("2006-01-02 15:04:05"))
+				}
+				//
+				trigger = due
+				//
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				//
+				timer.Reset(time.Until(due))
+			} else {
+				//
+				timer.Stop()
+				//
+				return
+			}
+		case <-timer.C:
+			// 复位计时
+			trigger = time.Time{}
+			first = time.Time{}
+			//
+			list := make([]string, 0, len(tableList))
+			// 检查标记
+			for key, _ := range tableList {
+				list = append(list, key)
+			}
+			//
+			sort.Strings(list)
+			// 清除标记
+			tableList = make(map[string]bool)
+			//
+			if nil == this.opts.schedule_notify {
+				logs.Info("开始备份数据库，发生改变的表为: %s", strings.Join(list, ","))
+			}
+			//
+			last = time.Now()
+			// 开始备份，关闭数据库时取消
+			err := this.BackupContext(this.loop_ctx)
+			//
+			if nil != this.opts.schedule_notify {
+				this.opts.schedule_notify(list, time.Since(last), err)
+			} else if nil != err {
+				logs.Error(err)
+			}
 		}
 	}
-	return 0, nil
 }
 
 func (this *SQLiteDB) CreateTable(name, structure string, flags ...bool) bool {
@@ -260,27 +604,134 @@ func (this *SQLiteDB) CreateTable(name, structure string, flags ...bool) bool {
 }
 
 func (this *SQLiteDB) Backup() error {
-	if "" != this.opts.backup_path {
-		if 0 < this.opts.backup_max {
-			if ext := filepath.Ext(this.opts.backup_path); "" != ext {
-				var path1, path2 string
+	return this.BackupContext(context.Background())
+}
+
+// 可取消的备份，ctx结束时放弃本次备份，保留上一次的备份文件
+func (this *SQLiteDB) BackupContext(ctx context.Context) error {
+	//
+	if nil != this.opts.crypt_err {
+		return this.opts.crypt_err
+	}
+	// 等待正在进行的备份结束
+	if err := this.lockBackup(ctx); nil != err {
+		return err
+	}
+	//
+	defer this.unlockBackup()
+	// 已取消时不再切换日志及轮换备份文件
+	if err := ctx.Err(); nil != err {
+		return err
+	}
+	//
+	this.Lock()
+	//
+	j := this.journal
+	//
+	this.Unlock()
+	// 备份开始前切换日志，备份期间的变化写入新日志
+	if nil != j {
+		if err := j.Rotate(); nil != err {
+			logs.Error(err)
+		}
+	}
+	//
+	start := time.Now()
+	//
+	incremental, err := this.backup(ctx)
+	//
+	this.stats.backup(start, incremental, this.opts.backup_path, err)
+	// 备份成功后压缩日志
+	if nil == err && nil != j {
+		j.Compact()
+	}
+	// 备份成功后按保留策略归档并检查空间占用
+	if nil == err {
+		this.retain()
+	}
+	//
+	return err
+}
+
+func (this *SQLiteDB) lockBackup(ctx context.Context) error {
+	select {
+	case this.backup_lock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (this *SQLiteDB) unlockBackup() {
+	<-this.backup_lock
+}
+
+// 按backup_max轮换备份文件，keep为true时复制而不是移动当前备份文件，供增量备份在原文件上修改
+func (this *SQLiteDB) rotateBackups(keep bool) error {
+	if 0 < this.opts.backup_max {
+		if ext := filepath.Ext(this.opts.backup_path); "" != ext {
+			var path1, path2 string
+			//
+			basepath := this.opts.backup_path[:len(this.opts.backup_path)-len(ext)]
+			//
+			first := fmt.Sprintf("%s.000%s", basepath, ext)
+			// 先复制到临时文件，复制失败时不轮换
+			if keep {
+				if err := sqliteCopyFile(this.opts.backup_path, first+".new"); nil != err {
+					return err
+				}
+			}
+			//
+			for i := this.opts.backup_max - 1; 0 <= i; i-- {
 				//
-				basepath := this.opts.backup_path[:len(this.opts.backup_path)-len(ext)]
+				if 0 == i {
+					path1 = this.opts.backup_path
+					path2 = first
+				} else {
+					path1 = fmt.Sprintf("%s.%03d%s", basepath, i-1, ext)
+					path2 = fmt.Sprintf("%s.%03d%s", basepath, i, ext)
+				}
 				//
-				for i := this.opts.backup_max - 1; 0 <= i; i-- {
-					//
-					if 0 == i {
-						path1 = this.opts.backup_path
-						path2 = fmt.Sprintf("%s.000%s", basepath, ext)
-					} else {
-						path1 = fmt.Sprintf("%s.%03d%s", basepath, i-1, ext)
-						path2 = fmt.Sprintf("%s.%03d%s", basepath, i, ext)
-					}
-					//
+				if keep && 0 == i {
+					os.Rename(first+".new", first)
+				} else {
 					os.Rename(path1, path2)
 				}
+				// 校验文件随备份文件一起轮换
+				os.Remove(path2 + checksumExt)
+				//
+				if keep && 0 == i {
+					sqliteWriteChecksum(first)
+				} else {
+					os.Rename(path1+checksumExt, path2+checksumExt)
+				}
 			}
 		}
+	}
+	return nil
+}
+
+// 返回是否为增量备份，调用者需持有备份锁
+func (this *SQLiteDB) backup(ctx context.Context) (bool, error) {
+	if "" != this.opts.backup_path {
+		// 优先增量备份，增量备份失败时备份文件可能已经轮换
+		rotated := false
+
+		if this.opts.backup_incremental {
+			if ok, _rotated := this.backupIncremental(ctx); ok {
+				return true, nil
+			} else {
+				rotated = _rotated
+			}
+		}
+
+		if err := ctx.Err(); nil != err {
+			return false, err
+		}
+
+		if !rotated {
+			this.rotateBackups(false)
+		}
 
 		start := time.Now()
 
@@ -290,35 +741,102 @@ func (this *SQLiteDB) Backup() error {
 			logs.Info("数据库备份完成, 耗时: %v...", time.Since(start))
 		}()
 
-		this.Lock()
-		defer this.Unlock()
-
-		// 打开备份数据库
-		if db, err := sql.Open(this.opts.dbchan_backup, this.opts.backup_path); nil == err {
-			// 关闭数据库
-			defer db.Close()
-			// 通过Ping方法激活数据库
-			if err := db.Ping(); nil == err {
-				return nil
+		this.resetIncremental()
+
+		// 加密时先备份到权限为0600的临时文件，加密时读取后立即删除
+		target := this.opts.backup_path
+
+		if this.encrypted() {
+			if tmp, err := this.plainTemp(); nil == err {
+				target = tmp
 			} else {
-				return err
+				atomic.StoreInt64(&this.schema, -1)
+				return false, err
 			}
-		} else {
-			return err
+
+			defer os.Remove(target)
 		}
+
+		if err := this.backupTo(ctx, target); nil != err {
+			// 轮换后新建的备份文件在备份中止时为空，删除后恢复时将使用上一代备份
+			if info, _err := os.Stat(target); nil == _err && 0 == info.Size() {
+				os.Remove(target)
+			}
+			atomic.StoreInt64(&this.schema, -1)
+			return false, err
+		}
+
+		// 备份完成后检查完整性，不通过时不写入校验文件，恢复时将跳过该文件
+		if err := sqliteIntegrityCheck(target); nil != err {
+			atomic.StoreInt64(&this.schema, -1)
+			return false, err
+		}
+
+		if this.encrypted() {
+			if err := this.sealFile(target, this.opts.backup_path); nil != err {
+				atomic.StoreInt64(&this.schema, -1)
+				return false, err
+			}
+		}
+
+		if err := sqliteWriteChecksum(this.opts.backup_path); nil != err {
+			logs.Error("unable write checksum, %v", err)
+		}
+
+		return false, nil
 	}
 
-	return fmt.Errorf("no backup file path be provided")
+	return false, fmt.Errorf("no backup file path be provided")
+}
+
+// 调用者需持有备份锁
+func (this *SQLiteDB) backupTo(ctx context.Context, path string) error {
+	//
+	this.backup_ctx = ctx
+	//
+	defer func() {
+		this.backup_ctx = nil
+	}()
+	// 打开备份数据库
+	if db, err := sql.Open(this.opts.dbchan_backup, path); nil == err {
+		// 关闭数据库
+		defer db.Close()
+		// 通过Ping方法激活数据库
+		return db.Ping()
+	} else {
+		return err
+	}
 }
 
 func (this *SQLiteDB) Close() {
 	if atomic.CompareAndSwapUint32(&this.opts.flag_groups[FlagStatus], 0x0, 0x1) {
 		this.store.Close()
 
-		this.Backup()
+		// 正在进行的自动备份被取消，由下面的最终备份代替
+		this.loop_cancel()
+
+		ctx := context.Background()
+
+		if 0 < this.opts.close_timeout {
+			var cancel context.CancelFunc
+
+			ctx, cancel = context.WithTimeout(ctx, this.opts.close_timeout)
+
+			defer cancel()
+		}
+
+		// 没有备份路径时不需要最终备份
+		if "" != this.opts.backup_path {
+			this.BackupContext(ctx)
+		}
 
 		this.Lock()
 
+		if nil != this.journal {
+			this.store.SetJournal(nil)
+			this.journal.Close()
+		}
+
 		this.conn.Close()
 
 		this.Unlock()
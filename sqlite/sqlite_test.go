@@ -0,0 +1,92 @@
+package sqlite
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testOpen(t *testing.T, opts ...Option) (*SQLiteDB, *sql.DB) {
+	//
+	db := NewSQLiteDB(opts...)
+	//
+	conn, err := db.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	return db, conn
+}
+
+// 名称不同的实例互不影响，名称相同的实例共享数据，名称中的特殊字符被转义
+func TestWithNameIsolation(t *testing.T) {
+	//
+	name := testName(t) + " a?b&c"
+	//
+	db1, conn1 := testOpen(t, WithName(name))
+	//
+	defer db1.Close()
+	//
+	db2, conn2 := testOpen(t, WithName(name))
+	//
+	defer db2.Close()
+	//
+	db3, conn3 := testOpen(t, WithName(name+"_other"))
+	//
+	defer db3.Close()
+	//
+	if _, err := conn1.Exec("CREATE TABLE t (v); INSERT INTO t VALUES (1);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	var cnt int
+	//
+	if err := conn2.QueryRow("SELECT COUNT(*) FROM t;").Scan(&cnt); nil != err {
+		t.Fatal(err)
+	} else if 1 != cnt {
+		t.Fatalf("shared database has %d rows", cnt)
+	}
+	//
+	if err := conn3.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name == 't';").Scan(&cnt); nil != err {
+		t.Fatal(err)
+	} else if 0 != cnt {
+		t.Fatal("table visible in another database")
+	}
+}
+
+// 使用文件数据库时数据在关闭后保留
+func TestWithDSN(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "dsn")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	path := filepath.Join(dir, "test.db")
+	//
+	db1, conn1 := testOpen(t, WithDSN(path))
+	//
+	if _, err := conn1.Exec("CREATE TABLE t (v); INSERT INTO t VALUES (1);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	db1.Close()
+	//
+	db2, conn2 := testOpen(t, WithDSN(path))
+	//
+	defer db2.Close()
+	//
+	var cnt int
+	//
+	if err := conn2.QueryRow("SELECT COUNT(*) FROM t;").Scan(&cnt); nil != err {
+		t.Fatal(err)
+	} else if 1 != cnt {
+		t.Fatalf("reopened database has %d rows", cnt)
+	}
+}
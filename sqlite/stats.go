@@ -0,0 +1,253 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// 统计每分钟变化数的时间片长度及数量
+	statsSlot  = 10
+	statsSlots = 6
+)
+
+// 单张表的变化统计
+type SQLiteTableStats struct {
+	Inserts uint64 `json:"inserts"`
+	Updates uint64 `json:"updates"`
+	Deletes uint64 `json:"deletes"`
+
+	// 最近一分钟的变化数
+	PerMinute uint64 `json:"per_minute"`
+}
+
+type SQLiteStats struct {
+	// 备份次数，含增量备份
+	Backups            uint64 `json:"backups"`
+	IncrementalBackups uint64 `json:"incremental_backups"`
+	BackupFailures     uint64 `json:"backup_failures"`
+
+	// 最近一次成功备份的时间、耗时及备份文件大小
+	LastBackup         time.Time     `json:"last_backup"`
+	LastBackupDuration time.Duration `json:"last_backup_duration"`
+	LastBackupSize     int64         `json:"last_backup_size"`
+
+	// 最近一次备份失败的原因
+	LastError string `json:"last_error,omitempty"`
+
+	// 各表的变化统计
+	Tables map[string]*SQLiteTableStats `json:"tables"`
+
+	// 最近一次恢复时各表同步的行数
+	SyncRows map[string]int64 `json:"sync_rows"`
+}
+
+type sqliteTableCounter struct {
+	ops [3]uint64
+
+	slots [statsSlots]uint64
+	stamp [statsSlots]int64
+}
+
+type sqliteStats struct {
+	sync.Mutex
+
+	backups     uint64
+	incremental uint64
+	failures    uint64
+
+	last     time.Time
+	duration time.Duration
+	size     int64
+	err      string
+
+	tables map[string]*sqliteTableCounter
+}
+
+// 由更新钩子调用
+func (this *sqliteStats) change(op int, table string, now time.Time) {
+	this.Lock()
+	defer this.Unlock()
+	//
+	if nil == this.tables {
+		this.tables = make(map[string]*sqliteTableCounter)
+	}
+	//
+	counter, ok := this.tables[table]
+	//
+	if !ok {
+		//
+		counter = &sqliteTableCounter{}
+		//
+		this.tables[table] = counter
+	}
+	//
+	switch op {
+	case sqlite3.SQLITE_INSERT:
+		counter.ops[0]++
+	case sqlite3.SQLITE_UPDATE:
+		counter.ops[1]++
+	case sqlite3.SQLITE_DELETE:
+		counter.ops[2]++
+	}
+	//
+	stamp := now.Unix() / statsSlot
+	//
+	if i := stamp % statsSlots; stamp != counter.stamp[i] {
+		counter.stamp[i] = stamp
+		counter.slots[i] = 1
+	} else {
+		counter.slots[i]++
+	}
+}
+
+func (this *sqliteStats) backup(start time.Time, incremental bool, path string, err error) {
+	this.Lock()
+	defer this.Unlock()
+	//
+	if nil == err {
+		//
+		this.backups++
+		//
+		if incremental {
+			this.incremental++
+		}
+		//
+		this.last = time.Now()
+		this.duration = this.last.Sub(start)
+		//
+		if info, err := os.Stat(path); nil == err {
+			this.size = info.Size()
+		}
+	} else if !errors.Is(err, context.Canceled) {
+		// 被取消的备份不算失败，超时仍计入
+		this.failures++
+		//
+		this.err = err.Error()
+	}
+}
+
+// 备份及变化统计
+func (this *SQLiteDB) Stats() *SQLiteStats {
+	//
+	result := &SQLiteStats{
+		Tables:   make(map[string]*SQLiteTableStats),
+		SyncRows: make(map[string]int64),
+	}
+	//
+	this.stats.Lock()
+	//
+	result.Backups = this.stats.backups
+	result.IncrementalBackups = this.stats.incremental
+	result.BackupFailures = this.stats.failures
+	result.LastBackup = this.stats.last
+	result.LastBackupDuration = this.stats.duration
+	result.LastBackupSize = this.stats.size
+	result.LastError = this.stats.err
+	//
+	stamp := time.Now().Unix() / statsSlot
+	//
+	for name, counter := range this.stats.tables {
+		//
+		item := &SQLiteTableStats{
+			Inserts: counter.ops[0],
+			Updates: counter.ops[1],
+			Deletes: counter.ops[2],
+		}
+		// 当前时间片未满，包含当前及之前的5个时间片
+		for i, _ := range counter.slots {
+			if stamp-counter.stamp[i] < statsSlots {
+				item.PerMinute += counter.slots[i]
+			}
+		}
+		//
+		result.Tables[name] = item
+	}
+	//
+	this.stats.Unlock()
+	//
+	for _, item := range this.SyncReport() {
+		result.SyncRows[item.Table] = item.Rows
+	}
+	//
+	return result
+}
+
+type sqliteCollector struct {
+	db *SQLiteDB
+
+	backups     *prometheus.Desc
+	incremental *prometheus.Desc
+	failures    *prometheus.Desc
+	last        *prometheus.Desc
+	duration    *prometheus.Desc
+	size        *prometheus.Desc
+	changes     *prometheus.Desc
+	rate        *prometheus.Desc
+	sync        *prometheus.Desc
+}
+
+// 返回Prometheus采集器，多个数据库需使用不同的namespace或constLabels区分
+func (this *SQLiteDB) Collector(namespace string, constLabels prometheus.Labels) prometheus.Collector {
+	//
+	name := func(s string) string {
+		return prometheus.BuildFQName(namespace, "sqlite", s)
+	}
+	//
+	return &sqliteCollector{
+		db:          this,
+		backups:     prometheus.NewDesc(name("backups_total"), "Number of successful backups, including incremental backups.", nil, constLabels),
+		incremental: prometheus.NewDesc(name("incremental_backups_total"), "Number of successful incremental backups.", nil, constLabels),
+		failures:    prometheus.NewDesc(name("backup_failures_total"), "Number of failed backups.", nil, constLabels),
+		last:        prometheus.NewDesc(name("last_backup_timestamp_seconds"), "Time of the last successful backup.", nil, constLabels),
+		duration:    prometheus.NewDesc(name("last_backup_duration_seconds"), "Duration of the last successful backup.", nil, constLabels),
+		size:        prometheus.NewDesc(name("last_backup_size_bytes"), "Size of the backup file after the last successful backup.", nil, constLabels),
+		changes:     prometheus.NewDesc(name("table_changes_total"), "Number of row changes per table seen by the update hook, including rolled back ones.", []string{"table", "op"}, constLabels),
+		rate:        prometheus.NewDesc(name("table_changes_per_minute"), "Number of row changes per table during the last minute.", []string{"table"}, constLabels),
+		sync:        prometheus.NewDesc(name("sync_rows"), "Number of rows restored per table by the last StartBackup.", []string{"table"}, constLabels),
+	}
+}
+
+func (this *sqliteCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- this.backups
+	ch <- this.incremental
+	ch <- this.failures
+	ch <- this.last
+	ch <- this.duration
+	ch <- this.size
+	ch <- this.changes
+	ch <- this.rate
+	ch <- this.sync
+}
+
+func (this *sqliteCollector) Collect(ch chan<- prometheus.Metric) {
+	//
+	stats := this.db.Stats()
+	//
+	ch <- prometheus.MustNewConstMetric(this.backups, prometheus.CounterValue, float64(stats.Backups))
+	ch <- prometheus.MustNewConstMetric(this.incremental, prometheus.CounterValue, float64(stats.IncrementalBackups))
+	ch <- prometheus.MustNewConstMetric(this.failures, prometheus.CounterValue, float64(stats.BackupFailures))
+	//
+	if !stats.LastBackup.IsZero() {
+		ch <- prometheus.MustNewConstMetric(this.last, prometheus.GaugeValue, float64(stats.LastBackup.UnixNano())/1e9)
+		ch <- prometheus.MustNewConstMetric(this.duration, prometheus.GaugeValue, stats.LastBackupDuration.Seconds())
+		ch <- prometheus.MustNewConstMetric(this.size, prometheus.GaugeValue, float64(stats.LastBackupSize))
+	}
+	//
+	for name, item := range stats.Tables {
+		ch <- prometheus.MustNewConstMetric(this.changes, prometheus.CounterValue, float64(item.Inserts), name, "insert")
+		ch <- prometheus.MustNewConstMetric(this.changes, prometheus.CounterValue, float64(item.Updates), name, "update")
+		ch <- prometheus.MustNewConstMetric(this.changes, prometheus.CounterValue, float64(item.Deletes), name, "delete")
+		ch <- prometheus.MustNewConstMetric(this.rate, prometheus.GaugeValue, float64(item.PerMinute), name)
+	}
+	//
+	for name, rows := range stats.SyncRows {
+		ch <- prometheus.MustNewConstMetric(this.sync, prometheus.GaugeValue, float64(rows), name)
+	}
+}
@@ -0,0 +1,76 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 没有备份路径时关闭不进行备份，被取消的备份不计入失败
+func TestStatsBackupFailures(t *testing.T) {
+	//
+	db := NewSQLiteDB(WithName(testName(t)))
+	//
+	conn, err := db.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn.Exec("CREATE TABLE t (v); INSERT INTO t VALUES (1);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	db.Close()
+	//
+	if stats := db.Stats(); 0 != stats.Backups || 0 != stats.BackupFailures || 1 != stats.Tables["t"].Inserts {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	//
+	dir, err := ioutil.TempDir("", "stats")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	ctx, cancel := context.WithCancel(context.Background())
+	// 第一步完成后取消
+	db = NewSQLiteDB(
+		WithName(testName(t)),
+		WithBackup(filepath.Join(dir, "test.db")),
+		WithBackupProgress(func(remaining, total int) {
+			cancel()
+		}),
+	)
+	//
+	defer db.Close()
+	//
+	if conn, err = db.GetConn(); nil != err {
+		t.Fatal(err)
+	}
+	// 超过单步备份的页数
+	if _, err := conn.Exec("CREATE TABLE t (v); INSERT INTO t VALUES (zeroblob(8 << 20));"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if err := db.BackupContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected result %v", err)
+	}
+	//
+	if stats := db.Stats(); 0 != stats.Backups || 0 != stats.BackupFailures {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	//
+	if err := db.Backup(); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if stats := db.Stats(); 1 != stats.Backups || 0 != stats.BackupFailures || 0 == stats.LastBackupSize {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,339 @@
+package sqlite
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	OpInsert = sqlite3.SQLITE_INSERT
+	OpUpdate = sqlite3.SQLITE_UPDATE
+	OpDelete = sqlite3.SQLITE_DELETE
+)
+
+const (
+	// 缓冲区满时丢弃新事件
+	OverflowDrop = iota
+	// 缓冲区满时将事件放入与缓冲区等长的队列，队列中同一行的事件合并为最后一次操作，队列满时丢弃新的行
+	OverflowCoalesce
+	// 缓冲区满时阻塞写入者，订阅者处理事件时不能访问同一数据库，否则会死锁
+	OverflowBlock
+)
+
+// 已提交的行变化
+type Event struct {
+	Op       int       `json:"op"`
+	Database string    `json:"database"`
+	Table    string    `json:"table"`
+	RowID    int64     `json:"rowid"`
+	Time     time.Time `json:"time"`
+}
+
+type subscribeOptions struct {
+	tables map[string]bool
+	ops    map[int]bool
+
+	size   int
+	policy int
+}
+
+type SubscribeOption func(*subscribeOptions)
+
+// 只订阅指定的表
+func SubscribeTables(tables ...string) SubscribeOption {
+	return func(opts *subscribeOptions) {
+		for _, item := range tables {
+			opts.tables[item] = true
+		}
+	}
+}
+
+// 只订阅指定的操作: OpInsert、OpUpdate、OpDelete
+func SubscribeOps(ops ...int) SubscribeOption {
+	return func(opts *subscribeOptions) {
+		for _, item := range ops {
+			opts.ops[item] = true
+		}
+	}
+}
+
+// 事件通道缓冲区长度
+func SubscribeBuffer(size int) SubscribeOption {
+	return func(opts *subscribeOptions) {
+		if 0 <= size {
+			opts.size = size
+		}
+	}
+}
+
+// 缓冲区满时的处理策略
+func SubscribeOverflow(policy int) SubscribeOption {
+	return func(opts *subscribeOptions) {
+		opts.policy = policy
+	}
+}
+
+type Subscription struct {
+	sync.Mutex
+
+	opts subscribeOptions
+
+	store *sqliteRawConnStore
+
+	ch chan *Event
+
+	// 合并策略下缓冲区满时的待发送事件，sending为正在送入通道的事件
+	queue   []*Event
+	index   map[sqliteEventKey]*Event
+	sending bool
+
+	notify chan struct{}
+	done   chan struct{}
+
+	wg sync.WaitGroup
+
+	once sync.Once
+
+	dropped uint64
+	merged  uint64
+}
+
+type sqliteEventKey struct {
+	table string
+	rowid int64
+}
+
+// 订阅已提交的行变化，不再使用时需调用Cancel
+func (this *SQLiteDB) Subscribe(opts ...SubscribeOption) *Subscription {
+	//
+	sub := &Subscription{
+		opts: subscribeOptions{
+			tables: make(map[string]bool),
+			ops:    make(map[int]bool),
+			size:   64,
+		},
+		store:  &this.store,
+		done:   make(chan struct{}),
+		notify: make(chan struct{}, 1),
+	}
+	//
+	for _, opt := range opts {
+		if nil != opt {
+			opt(&sub.opts)
+		}
+	}
+	//
+	sub.ch = make(chan *Event, sub.opts.size)
+	//
+	if OverflowCoalesce == sub.opts.policy {
+		//
+		sub.index = make(map[sqliteEventKey]*Event)
+		//
+		sub.wg.Add(1)
+		//
+		go sub.loop()
+	}
+	//
+	this.store.subscribe(sub)
+	//
+	return sub
+}
+
+// 事件通道，取消订阅或数据库关闭后被关闭
+func (this *Subscription) Events() <-chan *Event {
+	return this.ch
+}
+
+// 被丢弃的事件数量
+func (this *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&this.dropped)
+}
+
+// 合并策略下被合并到同一行后续事件中的事件数量
+func (this *Subscription) Merged() uint64 {
+	return atomic.LoadUint64(&this.merged)
+}
+
+func (this *Subscription) Cancel() {
+	this.once.Do(func() {
+		// 先唤醒阻塞的发送者
+		close(this.done)
+		//
+		this.store.unsubscribe(this)
+		//
+		this.wg.Wait()
+		//
+		close(this.ch)
+	})
+}
+
+func (this *Subscription) match(item *sqliteChange) bool {
+	if 0 < len(this.opts.tables) && !this.opts.tables[item.table] {
+		return false
+	}
+	if 0 < len(this.opts.ops) && !this.opts.ops[item.op] {
+		return false
+	}
+	return true
+}
+
+func (this *Subscription) push(item *sqliteChange) {
+	//
+	ev := &Event{
+		Op:       item.op,
+		Database: item.db,
+		Table:    item.table,
+		RowID:    item.rowid,
+		Time:     item.time,
+	}
+	//
+	switch this.opts.policy {
+	case OverflowBlock:
+		select {
+		case this.ch <- ev:
+		case <-this.done:
+		}
+	case OverflowCoalesce:
+		//
+		key := sqliteEventKey{
+			table: item.table,
+			rowid: item.rowid,
+		}
+		//
+		this.Lock()
+		// 没有积压时直接送入通道，保持事件顺序
+		if 0 == len(this.queue) && !this.sending {
+			select {
+			case this.ch <- ev:
+				this.Unlock()
+				return
+			default:
+			}
+		}
+		//
+		if _ev, ok := this.index[key]; ok {
+			//
+			_ev.Op = ev.Op
+			_ev.Time = ev.Time
+			//
+			atomic.AddUint64(&this.merged, 1)
+		} else if len(this.queue) < this.limit() {
+			//
+			this.index[key] = ev
+			//
+			this.queue = append(this.queue, ev)
+		} else {
+			atomic.AddUint64(&this.dropped, 1)
+		}
+		//
+		this.Unlock()
+		//
+		select {
+		case this.notify <- struct{}{}:
+		default:
+		}
+	default:
+		select {
+		case this.ch <- ev:
+		default:
+			atomic.AddUint64(&this.dropped, 1)
+		}
+	}
+}
+
+// 合并队列的长度，至少为1
+func (this *Subscription) limit() int {
+	if 0 < this.opts.size {
+		return this.opts.size
+	}
+	return 1
+}
+
+// 合并策略下将队列中的事件送入通道
+func (this *Subscription) loop() {
+	//
+	defer this.wg.Done()
+	//
+	for {
+		//
+		this.Lock()
+		//
+		var ev *Event
+		//
+		if 0 < len(this.queue) {
+			//
+			ev = this.queue[0]
+			//
+			this.queue[0] = nil
+			this.queue = this.queue[1:]
+			//
+			delete(this.index, sqliteEventKey{
+				table: ev.Table,
+				rowid: ev.RowID,
+			})
+			//
+			this.sending = true
+		}
+		//
+		this.Unlock()
+		//
+		if nil != ev {
+			select {
+			case this.ch <- ev:
+			case <-this.done:
+				return
+			}
+			//
+			this.Lock()
+			this.sending = false
+			this.Unlock()
+		} else {
+			select {
+			case <-this.notify:
+			case <-this.done:
+				return
+			}
+		}
+	}
+}
+
+func (this *sqliteRawConnStore) subscribe(sub *Subscription) {
+	this.subLock.Lock()
+	defer this.subLock.Unlock()
+
+	if nil == this.subs {
+		this.subs = make(map[*Subscription]bool)
+	}
+
+	this.subs[sub] = true
+}
+
+func (this *sqliteRawConnStore) unsubscribe(sub *Subscription) {
+	this.subLock.Lock()
+	defer this.subLock.Unlock()
+
+	delete(this.subs, sub)
+}
+
+func (this *sqliteRawConnStore) subscribed() bool {
+	this.subLock.RLock()
+	defer this.subLock.RUnlock()
+
+	return 0 < len(this.subs)
+}
+
+func (this *sqliteRawConnStore) publish(list []sqliteChange) {
+	this.subLock.RLock()
+	defer this.subLock.RUnlock()
+
+	for sub, _ := range this.subs {
+		for i, _ := range list {
+			if sub.match(&list[i]) {
+				sub.push(&list[i])
+			}
+		}
+	}
+}
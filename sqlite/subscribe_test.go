@@ -0,0 +1,196 @@
+package sqlite
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func testSubscribeDB(t *testing.T) (*SQLiteDB, *sql.DB) {
+	//
+	db := NewSQLiteDB(WithName(testName(t)))
+	//
+	conn, err := db.GetConn()
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v INTEGER);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	return db, conn
+}
+
+// 读取事件直到通道在timeout内没有新事件
+func testDrainEvents(sub *Subscription, timeout time.Duration) (list []*Event) {
+	for {
+		select {
+		case ev := <-sub.Events():
+			list = append(list, ev)
+		case <-time.After(timeout):
+			return
+		}
+	}
+}
+
+// 不带条件的DELETE在有订阅者时逐行通知，DROP TABLE不被忽略
+func TestSubscribeDeleteAll(t *testing.T) {
+	//
+	db, conn := testSubscribeDB(t)
+	//
+	defer db.Close()
+	// 没有订阅者时同样可以删除表
+	if _, err := conn.Exec("INSERT INTO t (v) VALUES (1); DELETE FROM t; DROP TABLE t; CREATE TABLE t (id INTEGER PRIMARY KEY, v INTEGER);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	sub := db.Subscribe(SubscribeOps(OpDelete))
+	//
+	defer sub.Cancel()
+	//
+	if _, err := conn.Exec("INSERT INTO t (v) VALUES (1), (2); DELETE FROM t;"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if list := testDrainEvents(sub, 100*time.Millisecond); 2 != len(list) {
+		t.Fatalf("received %d delete events, expected 2", len(list))
+	}
+	//
+	if _, err := conn.Exec("DROP TABLE t;"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	var cnt int
+	//
+	if err := conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name == 't';").Scan(&cnt); nil != err {
+		t.Fatal(err)
+	} else if 0 != cnt {
+		t.Fatal("table not dropped")
+	}
+}
+
+// 缓冲区满时丢弃新事件
+func TestSubscribeDrop(t *testing.T) {
+	//
+	db, conn := testSubscribeDB(t)
+	//
+	defer db.Close()
+	//
+	sub := db.Subscribe(SubscribeBuffer(1), SubscribeOverflow(OverflowDrop))
+	//
+	defer sub.Cancel()
+	//
+	if _, err := conn.Exec("INSERT INTO t (v) VALUES (1), (2), (3);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if list := testDrainEvents(sub, 100*time.Millisecond); 1 != len(list) || 1 != list[0].RowID {
+		t.Fatalf("received %d events", len(list))
+	}
+	//
+	if 2 != sub.Dropped() {
+		t.Fatalf("dropped %d events, expected 2", sub.Dropped())
+	}
+}
+
+// 缓冲区未满时不合并，满时合并同一行的事件，队列满时丢弃新的行
+func TestSubscribeCoalesce(t *testing.T) {
+	//
+	db, conn := testSubscribeDB(t)
+	//
+	defer db.Close()
+	//
+	sub := db.Subscribe(SubscribeBuffer(8), SubscribeOverflow(OverflowCoalesce))
+	//
+	if _, err := conn.Exec("INSERT INTO t (v) VALUES (1); UPDATE t SET v = 2; UPDATE t SET v = 3;"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if list := testDrainEvents(sub, 100*time.Millisecond); 3 != len(list) || OpUpdate != list[2].Op {
+		t.Fatalf("received %d events", len(list))
+	}
+	//
+	if 0 != sub.Merged() || 0 != sub.Dropped() {
+		t.Fatalf("merged %d, dropped %d", sub.Merged(), sub.Dropped())
+	}
+	//
+	sub.Cancel()
+	// 同一行的事件只会合并
+	sub = db.Subscribe(SubscribeBuffer(1), SubscribeOverflow(OverflowCoalesce))
+	//
+	if _, err := conn.Exec("BEGIN; DELETE FROM t; INSERT INTO t (id, v) VALUES (1, 0);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	for i := 0; 100 > i; i++ {
+		if _, err := conn.Exec("UPDATE t SET v = v + 1;"); nil != err {
+			t.Fatal(err)
+		}
+	}
+	//
+	if _, err := conn.Exec("COMMIT;"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	list := testDrainEvents(sub, 100*time.Millisecond)
+	//
+	if 102 != uint64(len(list))+sub.Merged() || 0 != sub.Dropped() || OpUpdate != list[len(list)-1].Op {
+		t.Fatalf("received %d events, merged %d, dropped %d", len(list), sub.Merged(), sub.Dropped())
+	}
+	//
+	sub.Cancel()
+	// 不同的行超出队列长度时丢弃
+	sub = db.Subscribe(SubscribeBuffer(1), SubscribeOverflow(OverflowCoalesce))
+	//
+	defer sub.Cancel()
+	//
+	if _, err := conn.Exec("WITH RECURSIVE n(i) AS (SELECT 2 UNION ALL SELECT i + 1 FROM n WHERE 101 > i) INSERT INTO t (id, v) SELECT i, i FROM n;"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	list = testDrainEvents(sub, 100*time.Millisecond)
+	//
+	if 100 != uint64(len(list))+sub.Dropped() || 0 == sub.Dropped() || 0 != sub.Merged() {
+		t.Fatalf("received %d events, merged %d, dropped %d", len(list), sub.Merged(), sub.Dropped())
+	}
+}
+
+// 缓冲区满时阻塞写入者，事件按顺序送达
+func TestSubscribeBlock(t *testing.T) {
+	//
+	db, conn := testSubscribeDB(t)
+	//
+	defer db.Close()
+	//
+	sub := db.Subscribe(SubscribeBuffer(1), SubscribeOverflow(OverflowBlock))
+	//
+	defer sub.Cancel()
+	//
+	result := make(chan error, 1)
+	//
+	go func() {
+		_, err := conn.Exec("INSERT INTO t (v) VALUES (1), (2), (3);")
+		result <- err
+	}()
+	//
+	for i := int64(1); 3 >= i; i++ {
+		select {
+		case ev := <-sub.Events():
+			if i != ev.RowID {
+				t.Fatalf("received row %d, expected %d", ev.RowID, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("event not received")
+		}
+	}
+	//
+	if err := <-result; nil != err {
+		t.Fatal(err)
+	}
+	//
+	if 0 != sub.Dropped() {
+		t.Fatalf("dropped %d events", sub.Dropped())
+	}
+}
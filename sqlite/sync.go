@@ -14,11 +14,57 @@ import (
 type sqliteTableInfo struct {
 	name string
 	sql  string
+	old  string
 	sync bool
 	cnt  int64
 }
 
+type sqliteColumnInfo struct {
+	name    string
+	ctype   string
+	notnull bool
+	dflt    sql.NullString
+	pk      int
+}
+
+// 单表同步结果
+type SQLiteSyncReport struct {
+	Table string `json:"table"`
+
+	// 成功复制的行数，有行无法写入时整表回滚，Failed为备份中的行数
+	Rows   int64 `json:"rows"`
+	Failed int64 `json:"failed,omitempty"`
+
+	// 复制的列、备份中被丢弃的列、以零值填充的新列
+	Copied    []string `json:"copied,omitempty"`
+	Dropped   []string `json:"dropped,omitempty"`
+	Defaulted []string `json:"defaulted,omitempty"`
+
+	// 无法同步时导出的JSON文件
+	Dump string `json:"dump,omitempty"`
+}
+
+func (this *SQLiteSyncReport) String() string {
+	if "" != this.Dump {
+		return fmt.Sprintf("%s: 无法同步, 已导出到%s", this.Table, this.Dump)
+	}
+	return fmt.Sprintf(
+		"%s: 同步%d行(失败%d行), 复制列%v, 丢弃列%v, 填充列%v",
+		this.Table,
+		this.Rows,
+		this.Failed,
+		this.Copied,
+		this.Dropped,
+		this.Defaulted,
+	)
+}
+
 func SQLiteSync(master, slave *sql.DB, dir string) (int64, error) {
+	n, _, err := SQLiteSyncWithReport(master, slave, dir)
+	return n, err
+}
+
+func SQLiteSyncWithReport(master, slave *sql.DB, dir string) (int64, []*SQLiteSyncReport, error) {
 	if err := master.Ping(); nil == err {
 		if err := slave.Ping(); nil == err {
 			var list []*sqliteTableInfo
@@ -36,7 +82,8 @@ func SQLiteSync(master, slave *sql.DB, dir string) (int64, error) {
 							})
 						}
 					} else {
-						return 0, err
+						rows.Close()
+						return 0, nil, err
 					}
 				}
 				//
@@ -46,9 +93,11 @@ func SQLiteSync(master, slave *sql.DB, dir string) (int64, error) {
 					if row := slave.QueryRow("SELECT sql FROM sqlite_master WHERE type=='table' AND tbl_name==?;", item.name); nil != row {
 						if err := row.Scan(&sql); nil == err {
 							//
-							item.sync = sql == item.sql
+							item.old = sql
+							//
+							item.sync = sqliteSameTable(sql, item.sql)
 							//
-							if row := slave.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s;", item.name)); nil != row {
+							if row := slave.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s;", sqliteQuote(item.name))); nil != row {
 								row.Scan(&item.cnt)
 							}
 						} else {
@@ -59,154 +108,294 @@ func SQLiteSync(master, slave *sql.DB, dir string) (int64, error) {
 				//
 				cnt := int64(0)
 				//
+				var reports []*SQLiteSyncReport
+				//
 				for _, item := range list {
 					if 0 < item.cnt {
+						//
+						report := &SQLiteSyncReport{
+							Table: item.name,
+						}
+						//
 						if item.sync {
-							//...
 							logs.Info("正在同步: ", item.name)
+						} else {
+							logs.Warn("正在迁移: ", item.name)
+						}
+						//
+						if err := sqliteSyncTable(master, slave, item, report); nil == err {
+							cnt += report.Rows
+						} else {
 							//
-							if rows, err := slave.Query(fmt.Sprintf("SELECT * FROM %s;", item.name)); nil == err {
-								if types, err := rows.ColumnTypes(); nil == err {
-									if tx, err := master.Begin(); nil == err {
-										sql := "INSERT INTO " + item.name + " ("
-										for i, _ := range types {
-											if 0 != i {
-												sql += ", "
-											}
-											sql += types[i].Name()
-										}
-										sql += ") VALUES ("
-										for i, _ := range types {
-											if 0 != i {
-												sql += ", "
-											}
-											sql += "?"
-										}
-										sql += ");"
-										if stmt, err := tx.Prepare(sql); nil == err {
-											value := make([]interface{}, len(types))
-											for i, _ := range value {
-												switch strings.ToLower(types[i].DatabaseTypeName()) {
-												case "integer":
-													value[i] = new(int64)
-												case "float":
-													value[i] = new(float64)
-												case "blob":
-													value[i] = new([]byte)
-												case "text":
-													value[i] = new(string)
-												case "timestamp", "datetime", "date":
-													value[i] = new(time.Time)
-												case "boolean":
-													value[i] = new(bool)
-												default:
-													logs.Error("不支持的类型:", types[i].DatabaseTypeName())
-												}
-											}
-											//
-											for rows.Next() {
-												if err := rows.Scan(value...); nil == err {
-													if _, err := stmt.Exec(value...); nil == err {
-														cnt++
-													} else {
-														logs.Error(err)
-													}
-												} else {
-													logs.Error(err)
-												}
-											}
-											//
-											if err := tx.Commit(); nil != err {
-												logs.Error(err)
-											}
-											//
-											stmt.Close()
-										} else {
-											logs.Error(err)
-										}
-									} else {
-										logs.Error(err)
-									}
-								} else {
-									logs.Error(err)
-								}
-								rows.Close()
-							} else {
-								logs.Error(err)
-							}
-						} else if "" != dir {
-							//...
-							logs.Warn("正在备份: ", item.name)
-							//
-							list := make([]interface{}, 0, int(item.cnt))
+							logs.Error(err)
 							//
-							if rows, err := slave.Query(fmt.Sprintf("SELECT * FROM %s;", item.name)); nil == err {
-								if types, err := rows.ColumnTypes(); nil == err {
-									for rows.Next() {
-										value := make([]interface{}, len(types))
-										for i, _ := range value {
-											switch strings.ToLower(types[i].DatabaseTypeName()) {
-											case "integer":
-												value[i] = new(int64)
-											case "float":
-												value[i] = new(float64)
-											case "blob":
-												value[i] = new([]byte)
-											case "text":
-												value[i] = new(string)
-											case "timestamp", "datetime", "date":
-												value[i] = new(time.Time)
-											case "boolean":
-												value[i] = new(bool)
-											default:
-												logs.Info("不支持的类型:", types[i].DatabaseTypeName())
-											}
-										}
-										if err := rows.Scan(value...); nil == err {
-											list = append(list, value)
-										}
-									}
-								} else {
-									logs.Error(err)
-								}
+							if "" != dir {
+								//...
+								logs.Warn("正在备份: ", item.name)
 								//
-								rows.Close()
-							} else {
-								logs.Error(err)
+								report.Dump = sqliteDumpTable(slave, item, dir)
 							}
-							if data, err := json.Marshal(&struct {
-								SQL   string      `json:"sql"`
-								Count int64       `json:"count"`
-								List  interface{} `json:"list"`
-							}{
-								SQL:   item.sql,
-								Count: item.cnt,
-								List:  list,
-							}); nil == err {
-								ioutil.WriteFile(
-									fmt.Sprintf(
-										"%s/sqlite_backup_%s_%d.json",
-										dir,
-										item.name,
-										time.Now().Unix(),
-									),
-									data,
-									0644,
-								)
+						}
+						//
+						reports = append(reports, report)
+					}
+				}
+				return cnt, reports, nil
+			} else {
+				return 0, nil, err
+			}
+		} else {
+			return 0, nil, err
+		}
+	} else {
+		return 0, nil, err
+	}
+}
+
+// 按列名复制两个表的公共列，新增的非空列以零值填充
+func sqliteSyncTable(master, slave *sql.DB, item *sqliteTableInfo, report *SQLiteSyncReport) error {
+	//
+	columns, err := sqliteColumnInfos(master, item.name)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	old := columns
+	//
+	if !item.sync {
+		if old, err = sqliteColumnInfos(slave, item.name); nil != err {
+			return err
+		}
+	}
+	//
+	index := make(map[string]*sqliteColumnInfo)
+	//
+	for _, col := range old {
+		index[strings.ToLower(col.name)] = col
+	}
+	//
+	var pks int
+	//
+	for _, col := range columns {
+		if 0 < col.pk {
+			pks++
+		}
+	}
+	//
+	var src, dst, literals []string
+	//
+	for _, col := range columns {
+		if _col, ok := index[strings.ToLower(col.name)]; ok {
+			//
+			src = append(src, _col.name)
+			dst = append(dst, col.name)
+			//
+			delete(index, strings.ToLower(col.name))
+		} else if col.notnull && !col.dflt.Valid && !col.rowid(pks) {
+			//
+			report.Defaulted = append(report.Defaulted, col.name)
+			//
+			literals = append(literals, sqliteZeroLiteral(col.ctype))
+		}
+	}
+	//
+	for _, col := range old {
+		if _, ok := index[strings.ToLower(col.name)]; ok {
+			report.Dropped = append(report.Dropped, col.name)
+		}
+	}
+	//
+	if 0 == len(src) {
+		return fmt.Errorf("table %s has no common columns", item.name)
+	}
+	//
+	report.Copied = dst
+	//
+	var sb strings.Builder
+	//
+	fmt.Fprintf(&sb, "INSERT INTO %s (%s", sqliteQuote(item.name), sqliteQuoteList(dst))
+	//
+	if 0 < len(report.Defaulted) {
+		fmt.Fprintf(&sb, ", %s", sqliteQuoteList(report.Defaulted))
+	}
+	//
+	fmt.Fprintf(&sb, ") VALUES (?%s", strings.Repeat(", ?", len(dst)-1))
+	//
+	if 0 < len(literals) {
+		fmt.Fprintf(&sb, ", %s", strings.Join(literals, ", "))
+	}
+	//
+	sb.WriteString(");")
+	//
+	if rows, err := slave.Query(fmt.Sprintf("SELECT %s FROM %s;", sqliteQuoteList(src), sqliteQuote(item.name))); nil == err {
+		//
+		defer rows.Close()
+		//
+		if types, err := rows.ColumnTypes(); nil == err {
+			if tx, err := master.Begin(); nil == err {
+				if stmt, err := tx.Prepare(sb.String()); nil == err {
+					//
+					defer stmt.Close()
+					//
+					value := make([]interface{}, len(types))
+					//
+					for i, _ := range value {
+						value[i] = sqliteScanValue(types[i])
+					}
+					//
+					// 任一行失败时整表回滚，由调用者导出备份中的行
+					fail := func(err error) error {
+						//
+						tx.Rollback()
+						//
+						err = fmt.Errorf("table %s row %d, %w", item.name, report.Rows+1, err)
+						//
+						report.Failed = item.cnt
+						report.Rows = 0
+						//
+						return err
+					}
+					//
+					for rows.Next() {
+						if err := rows.Scan(value...); nil == err {
+							if _, err := stmt.Exec(value...); nil == err {
+								report.Rows++
 							} else {
-								logs.Error(err)
+								return fail(err)
 							}
+						} else {
+							return fail(err)
 						}
 					}
+					//
+					if err := rows.Err(); nil != err {
+						return fail(err)
+					}
+					//
+					return tx.Commit()
+				} else {
+					tx.Rollback()
+					return err
 				}
-				return cnt, nil
 			} else {
-				return 0, err
+				return err
 			}
 		} else {
-			return 0, err
+			return err
+		}
+	} else {
+		return err
+	}
+}
+
+// 将无法同步的表导出为JSON文件
+func sqliteDumpTable(slave *sql.DB, item *sqliteTableInfo, dir string) string {
+	//
+	list := make([]interface{}, 0, int(item.cnt))
+	//
+	if rows, err := slave.Query(fmt.Sprintf("SELECT * FROM %s;", sqliteQuote(item.name))); nil == err {
+		if types, err := rows.ColumnTypes(); nil == err {
+			for rows.Next() {
+				value := make([]interface{}, len(types))
+				for i, _ := range value {
+					value[i] = sqliteScanValue(types[i])
+				}
+				if err := rows.Scan(value...); nil == err {
+					list = append(list, value)
+				}
+			}
+		} else {
+			logs.Error(err)
+		}
+		//
+		rows.Close()
+	} else {
+		logs.Error(err)
+	}
+	if data, err := json.Marshal(&struct {
+		SQL   string      `json:"sql"`
+		Count int64       `json:"count"`
+		List  interface{} `json:"list"`
+	}{
+		// 导出的是备份中的行，需保存备份中的建表语句
+		SQL:   item.old,
+		Count: item.cnt,
+		List:  list,
+	}); nil == err {
+		//
+		path := fmt.Sprintf(
+			"%s/sqlite_backup_%s_%d.json",
+			dir,
+			item.name,
+			time.Now().Unix(),
+		)
+		//
+		if err := ioutil.WriteFile(path, data, 0644); nil == err {
+			return path
+		} else {
+			logs.Error(err)
+		}
+	} else {
+		logs.Error(err)
+	}
+	return ""
+}
+
+func sqliteColumnInfos(q sqliteQueryer, table string) ([]*sqliteColumnInfo, error) {
+	var list []*sqliteColumnInfo
+	//
+	if rows, err := q.Query(fmt.Sprintf("PRAGMA main.table_info(%s);", sqliteQuote(table))); nil == err {
+		//
+		defer rows.Close()
+		//
+		var cid int
+		//
+		for rows.Next() {
+			//
+			col := &sqliteColumnInfo{}
+			//
+			if err := rows.Scan(&cid, &col.name, &col.ctype, &col.notnull, &col.dflt, &col.pk); nil == err {
+				list = append(list, col)
+			} else {
+				return nil, err
+			}
 		}
+		//
+		return list, rows.Err()
 	} else {
-		return 0, err
+		return nil, err
+	}
+}
+
+// 只有单列的INTEGER PRIMARY KEY为rowid的别名，插入时自动分配，pks为表中主键的列数
+func (this *sqliteColumnInfo) rowid(pks int) bool {
+	return 1 == pks && 0 < this.pk && "INTEGER" == strings.ToUpper(strings.TrimSpace(this.ctype))
+}
+
+func sqliteZeroLiteral(decl string) string {
+	switch sqliteAffinity(decl) {
+	case affinityText:
+		return "''"
+	case affinityBlob:
+		return "x''"
+	case affinityReal:
+		return "0.0"
+	}
+	return "0"
+}
+
+// 比较建表语句，忽略表名(迁移中重命名会带上引号)及空白差异
+func sqliteSameTable(a, b string) bool {
+	if a == b {
+		return true
+	}
+	//
+	if i := strings.IndexByte(a, '('); 0 < i {
+		if j := strings.IndexByte(b, '('); 0 < j {
+			return strings.Join(strings.Fields(a[i:]), " ") == strings.Join(strings.Fields(b[j:]), " ")
+		}
 	}
+	//
+	return false
 }
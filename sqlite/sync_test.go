@@ -0,0 +1,117 @@
+package sqlite
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// 备份中的行违反新表的约束时整表回滚，备份中的行导出为JSON文件
+func TestSyncMismatchedSchema(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "sync")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	var list [2]*sql.DB
+	//
+	for i, create := range []string{
+		"CREATE TABLE t (id INTEGER PRIMARY KEY, v INTEGER NOT NULL CHECK (0 < v));",
+		"CREATE TABLE t (id INTEGER PRIMARY KEY, v INTEGER); INSERT INTO t VALUES (1, 1), (2, -1), (3, 3);",
+	} {
+		if db, err := sql.Open("sqlite3", ":memory:"); nil == err {
+			//
+			defer db.Close()
+			//
+			db.SetMaxOpenConns(1)
+			//
+			if _, err := db.Exec(create); nil != err {
+				t.Fatal(err)
+			}
+			//
+			list[i] = db
+		} else {
+			t.Fatal(err)
+		}
+	}
+	//
+	n, reports, err := SQLiteSyncWithReport(list[0], list[1], dir)
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if 0 != n || 1 != len(reports) {
+		t.Fatalf("synced %d rows, %d reports", n, len(reports))
+	}
+	//
+	if report := reports[0]; 0 != report.Rows || 3 != report.Failed || "" == report.Dump {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	//
+	var cnt int
+	//
+	if err := list[0].QueryRow("SELECT COUNT(*) FROM t;").Scan(&cnt); nil != err {
+		t.Fatal(err)
+	} else if 0 != cnt {
+		t.Fatalf("%d rows left after rollback", cnt)
+	}
+	// 导出的是备份中的全部行
+	if data, err := ioutil.ReadFile(reports[0].Dump); nil == err {
+		if dump := string(data); !strings.Contains(dump, `"count":3`) || !strings.Contains(dump, `[2,-1]`) {
+			t.Fatalf("unexpected dump %s", dump)
+		}
+	} else {
+		t.Fatal(err)
+	}
+}
+
+// 复合主键中的INTEGER列不是rowid的别名，新增的非空列以零值填充
+func TestSyncCompositeKey(t *testing.T) {
+	//
+	var list [2]*sql.DB
+	//
+	for i, create := range []string{
+		"CREATE TABLE t (a INTEGER NOT NULL, b INTEGER NOT NULL, c TEXT, PRIMARY KEY (a, b));",
+		"CREATE TABLE t (a INTEGER NOT NULL PRIMARY KEY, c TEXT); INSERT INTO t VALUES (1, 'x'), (2, 'y');",
+	} {
+		if db, err := sql.Open("sqlite3", ":memory:"); nil == err {
+			//
+			defer db.Close()
+			//
+			db.SetMaxOpenConns(1)
+			//
+			if _, err := db.Exec(create); nil != err {
+				t.Fatal(err)
+			}
+			//
+			list[i] = db
+		} else {
+			t.Fatal(err)
+		}
+	}
+	//
+	n, reports, err := SQLiteSyncWithReport(list[0], list[1], "")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if 2 != n || 1 != len(reports) || 1 != len(reports[0].Defaulted) || "b" != reports[0].Defaulted[0] {
+		t.Fatalf("synced %d rows, reports %+v", n, reports)
+	}
+	//
+	var result string
+	//
+	if err := list[0].QueryRow("SELECT group_concat(a || b || c, ',') FROM t;").Scan(&result); nil != err {
+		t.Fatal(err)
+	} else if "10x,20y" != result {
+		t.Fatalf("synced %s", result)
+	}
+}
@@ -0,0 +1,97 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	// 遇到SQLITE_BUSY/SQLITE_LOCKED时的最大重试次数
+	TxRetryMax = 10
+
+	// 重试的初始及最大等待时间
+	TxRetryDelay    = 10 * time.Millisecond
+	TxRetryMaxDelay = time.Second
+)
+
+// 在事务中执行fn，fn返回错误或panic时回滚，数据库忙时按指数退避重试整个事务
+// fn可能被执行多次，不应有事务以外的副作用
+func (this *SQLiteDB) WithTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	//
+	conn, err := this.GetConn(true)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	delay := TxRetryDelay
+	//
+	if 0 >= delay {
+		delay = time.Millisecond
+	}
+	//
+	for i := 0; ; i++ {
+		//
+		err := sqliteRunTx(ctx, conn, fn)
+		//
+		if nil == err || !sqliteIsBusy(err) || TxRetryMax <= i {
+			return err
+		}
+		// 加入随机抖动，避免多个写入者同时重试
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		//
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w, last error: %v", ctx.Err(), err)
+		case <-time.After(wait):
+		}
+		//
+		if delay *= 2; TxRetryMaxDelay < delay {
+			delay = TxRetryMaxDelay
+		}
+	}
+}
+
+func sqliteRunTx(ctx context.Context, conn *sql.DB, fn func(*sql.Tx) error) (err error) {
+	//
+	tx, err := conn.BeginTx(ctx, nil)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	defer func() {
+		if r := recover(); nil != r {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+	//
+	if err = fn(tx); nil != err {
+		tx.Rollback()
+		return err
+	}
+	//
+	if err = tx.Commit(); nil != err {
+		tx.Rollback()
+	}
+	//
+	return err
+}
+
+func sqliteIsBusy(err error) bool {
+	//
+	var e sqlite3.Error
+	//
+	if errors.As(err, &e) {
+		return sqlite3.ErrBusy == e.Code || sqlite3.ErrLocked == e.Code
+	}
+	//
+	return false
+}
@@ -0,0 +1,72 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// 数据库忙时重试整个事务，失败的尝试被回滚，其余错误不重试
+func TestWithTxBusyRetry(t *testing.T) {
+	//
+	db, conn := testOpen(t, WithName(testName(t)))
+	//
+	defer db.Close()
+	//
+	if _, err := conn.Exec("CREATE TABLE t (v);"); nil != err {
+		t.Fatal(err)
+	}
+	//
+	busy := fmt.Errorf("insert failed, %w", sqlite3.Error{Code: sqlite3.ErrBusy})
+	//
+	var cnt int
+	//
+	if err := db.WithTx(context.Background(), func(tx *sql.Tx) error {
+		//
+		if _, err := tx.Exec("INSERT INTO t VALUES (?);", cnt); nil != err {
+			return err
+		}
+		//
+		if cnt++; 3 > cnt {
+			return busy
+		}
+		//
+		return nil
+	}); nil != err {
+		t.Fatal(err)
+	}
+	//
+	var result string
+	//
+	if err := conn.QueryRow("SELECT group_concat(v) FROM t;").Scan(&result); nil != err {
+		t.Fatal(err)
+	} else if 3 != cnt || "2" != result {
+		t.Fatalf("%d attempts, committed %s", cnt, result)
+	}
+	//
+	failed := errors.New("failed")
+	//
+	cnt = 0
+	//
+	if err := db.WithTx(context.Background(), func(tx *sql.Tx) error {
+		cnt++
+		return failed
+	}); failed != err || 1 != cnt {
+		t.Fatalf("%d attempts, %v", cnt, err)
+	}
+	// 取消后不再重试
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	//
+	defer cancel()
+	//
+	if err := db.WithTx(ctx, func(tx *sql.Tx) error {
+		return busy
+	}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected result %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package sqlite
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// 导出JSON时BLOB值的标记
+	jsonBlobKey = "$b64"
+)
+
+const (
+	affinityInteger = iota
+	affinityText
+	affinityBlob
+	affinityReal
+	affinityNumeric
+)
+
+var (
+	converterLock sync.RWMutex
+
+	converters = make(map[string]func() interface{})
+)
+
+// 为声明类型注册扫描目标，用于SQLiteSync复制及导出数据
+// 类型名不区分大小写且忽略括号中的参数，fn返回的值须能用作rows.Scan的目标及Exec的参数，并可被JSON编码
+func RegisterTypeConverter(decl string, fn func() interface{}) {
+	//
+	converterLock.Lock()
+	defer converterLock.Unlock()
+	//
+	if nil != fn {
+		converters[sqliteTypeName(decl)] = fn
+	} else {
+		delete(converters, sqliteTypeName(decl))
+	}
+}
+
+// 根据列的声明类型返回扫描目标，未注册的类型按SQLite类型亲和性处理
+func sqliteScanValue(t *sql.ColumnType) interface{} {
+	return sqliteScanDecl(t.DatabaseTypeName())
+}
+
+// 同sqliteScanValue，声明类型来自表结构
+func sqliteScanDecl(decl string) interface{} {
+	//
+	name := sqliteTypeName(decl)
+	//
+	converterLock.RLock()
+	//
+	fn, ok := converters[name]
+	//
+	converterLock.RUnlock()
+	//
+	if ok {
+		return fn()
+	}
+	//
+	return &sqliteAffinityValue{
+		affinity: sqliteAffinity(name),
+	}
+}
+
+// 小写并去掉长度等参数，如VARCHAR(32)为varchar
+func sqliteTypeName(decl string) string {
+	if i := strings.IndexByte(decl, '('); 0 <= i {
+		decl = decl[:i]
+	}
+	return strings.ToLower(strings.Join(strings.Fields(decl), " "))
+}
+
+// SQLite类型亲和性规则，见https://www.sqlite.org/datatype3.html
+func sqliteAffinity(decl string) int {
+	//
+	decl = strings.ToUpper(decl)
+	//
+	switch {
+	case strings.Contains(decl, "INT"):
+		return affinityInteger
+	case strings.Contains(decl, "CHAR"), strings.Contains(decl, "CLOB"), strings.Contains(decl, "TEXT"):
+		return affinityText
+	case strings.Contains(decl, "BLOB"), "" == strings.TrimSpace(decl):
+		return affinityBlob
+	case strings.Contains(decl, "REAL"), strings.Contains(decl, "FLOA"), strings.Contains(decl, "DOUB"):
+		return affinityReal
+	}
+	//
+	return affinityNumeric
+}
+
+// 可为NULL的扫描目标，按亲和性整理驱动返回的值
+type sqliteAffinityValue struct {
+	affinity int
+
+	value interface{}
+}
+
+func (this *sqliteAffinityValue) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		// 驱动会复用缓冲区
+		data := make([]byte, len(v))
+		copy(data, v)
+		this.value = data
+	case string:
+		this.value = v
+		// 与SQLite写入时的转换一致，文本形式的数值转为数值
+		switch this.affinity {
+		case affinityInteger, affinityNumeric:
+			if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); nil == err {
+				this.value = n
+			} else if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); nil == err {
+				this.value = f
+			}
+		case affinityReal:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); nil == err {
+				this.value = f
+			}
+		}
+	case int64:
+		this.value = v
+		//
+		if affinityReal == this.affinity {
+			this.value = float64(v)
+		}
+	default:
+		this.value = v
+	}
+	return nil
+}
+
+func (this *sqliteAffinityValue) Value() (driver.Value, error) {
+	return this.value, nil
+}
+
+// BLOB编码为{"$b64":"..."}，导入时与文本区分
+func (this *sqliteAffinityValue) MarshalJSON() ([]byte, error) {
+	if v, ok := this.value.([]byte); ok {
+		return json.Marshal(map[string]string{jsonBlobKey: base64.StdEncoding.EncodeToString(v)})
+	}
+	return json.Marshal(this.value)
+}
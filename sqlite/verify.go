@@ -0,0 +1,202 @@
+package sqlite
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/elitah/utils/logs"
+)
+
+const (
+	// 校验文件后缀，内容为备份文件的SHA256
+	checksumExt = ".sha256"
+)
+
+var (
+	EBackupCorrupt = errors.New("backup file corrupt")
+	ENoValidBackup = errors.New("no valid backup file be found")
+)
+
+// 备份文件及轮换文件，按从新到旧排列，第0代为备份文件本身，第n代为name.{n-1}.ext，归档文件的代数接在轮换文件之后
+func (this *SQLiteDB) backupGenerations() []string {
+	//
+	list := []string{this.opts.backup_path}
+	//
+	if 0 < this.opts.backup_max {
+		if basepath, ext := this.backupName(); "" != ext {
+			//
+			for i := 0; this.opts.backup_max > i; i++ {
+				list = append(list, fmt.Sprintf("%s.%03d%s", basepath, i, ext))
+			}
+		}
+	}
+	//
+	return list
+}
+
+// 最近一次StartBackup恢复数据使用的备份文件及其代数，未恢复时返回-1
+func (this *SQLiteDB) Restored() (string, int) {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.restored_path, this.restored
+}
+
+// 从新到旧查找第一个校验通过的备份文件，轮换文件之后尝试归档文件
+func (this *SQLiteDB) selectBackup() (string, int, error) {
+	//
+	var last error
+	//
+	for i, path := range append(this.backupGenerations(), this.backupArchives()...) {
+		//
+		info, err := os.Stat(path)
+		//
+		if nil != err {
+			if !os.IsNotExist(err) {
+				last = err
+				logs.Warn("备份文件%s不可用: %v", path, err)
+			}
+			continue
+		}
+		// 空文件表示备份时数据库为空
+		if 0 == info.Size() {
+			return path, i, nil
+		}
+		//
+		if err := this.verifyFile(path); nil == err {
+			return path, i, nil
+		} else if errors.Is(err, EBackupKey) {
+			// 加密文件格式正确但无法解密说明密钥错误，不能回退到更旧的(可能是明文的)备份
+			return "", -1, fmt.Errorf("unable decrypt backup file %s, %w", path, err)
+		} else {
+			last = err
+			logs.Warn("备份文件%s校验失败: %v", path, err)
+		}
+	}
+	//
+	if nil != last {
+		return "", -1, fmt.Errorf("%w, last error: %v", ENoValidBackup, last)
+	}
+	// 所有备份文件都不存在
+	_, err := os.Stat(this.opts.backup_path)
+	//
+	return "", -1, err
+}
+
+// 校验备份文件的SHA256及数据库完整性，归档文件由gzip自带的CRC校验
+func (this *SQLiteDB) verifyFile(path string) error {
+	//
+	if !sqliteIsArchive(path) {
+		if err := sqliteVerifyChecksum(path); nil != err {
+			return err
+		}
+	}
+	//
+	plain, cleanup, _, err := this.openBackup(path)
+	//
+	if nil != err {
+		return err
+	}
+	//
+	defer cleanup()
+	//
+	return sqliteIntegrityCheck(plain)
+}
+
+func sqliteIntegrityCheck(path string) error {
+	if db, err := sql.Open("sqlite3", path); nil == err {
+		//
+		defer db.Close()
+		//
+		if rows, err := db.Query("PRAGMA integrity_check;"); nil == err {
+			//
+			defer rows.Close()
+			//
+			var list []string
+			//
+			for rows.Next() {
+				//
+				var result string
+				//
+				if err := rows.Scan(&result); nil != err {
+					return err
+				}
+				//
+				list = append(list, result)
+			}
+			//
+			if err := rows.Err(); nil != err {
+				return fmt.Errorf("%w, %v", EBackupCorrupt, err)
+			}
+			//
+			if 1 == len(list) && "ok" == list[0] {
+				return nil
+			}
+			//
+			return fmt.Errorf("%w, %s", EBackupCorrupt, strings.Join(list, "; "))
+		} else {
+			return fmt.Errorf("%w, %v", EBackupCorrupt, err)
+		}
+	} else {
+		return err
+	}
+}
+
+func sqliteFileChecksum(path string) (string, error) {
+	if f, err := os.Open(path); nil == err {
+		//
+		defer f.Close()
+		//
+		h := sha256.New()
+		//
+		if _, err := io.Copy(h, f); nil == err {
+			return hex.EncodeToString(h.Sum(nil)), nil
+		} else {
+			return "", err
+		}
+	} else {
+		return "", err
+	}
+}
+
+// 写入校验文件
+func sqliteWriteChecksum(path string) error {
+	if sum, err := sqliteFileChecksum(path); nil == err {
+		//
+		tmp := path + checksumExt + ".tmp"
+		//
+		if err := ioutil.WriteFile(tmp, []byte(sum+"\n"), 0644); nil == err {
+			return os.Rename(tmp, path+checksumExt)
+		} else {
+			os.Remove(tmp)
+			return err
+		}
+	} else {
+		return err
+	}
+}
+
+// 校验文件不存在时视为旧版本的备份，只检查数据库完整性
+func sqliteVerifyChecksum(path string) error {
+	if data, err := ioutil.ReadFile(path + checksumExt); nil == err {
+		if sum, err := sqliteFileChecksum(path); nil == err {
+			if strings.TrimSpace(string(data)) != sum {
+				return fmt.Errorf("%w, checksum mismatch", EBackupCorrupt)
+			}
+			return nil
+		} else {
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		return nil
+	} else {
+		return err
+	}
+}
@@ -0,0 +1,64 @@
+package sqlite
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 密钥错误时不能回退到更旧的明文备份，错误可以用errors.Is判断
+func TestSelectBackupWrongKey(t *testing.T) {
+	//
+	dir, err := ioutil.TempDir("", "verify")
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer os.RemoveAll(dir)
+	//
+	backup := filepath.Join(dir, "test.db")
+	//
+	for i, opts := range [][]Option{
+		// 第一次为明文备份，轮换后成为第1代
+		{WithBackup(backup, 1)},
+		{WithBackup(backup, 1), WithEncryption("0123456789abcdef")},
+	} {
+		//
+		db := NewSQLiteDB(append(opts, WithName(t.Name()+string(rune('a'+i))))...)
+		//
+		conn, err := db.GetConn()
+		//
+		if nil != err {
+			t.Fatal(err)
+		}
+		//
+		if _, err := conn.Exec("CREATE TABLE IF NOT EXISTS t (v TEXT); INSERT INTO t VALUES ('x');"); nil != err {
+			t.Fatal(err)
+		}
+		//
+		if err := db.Backup(); nil != err {
+			t.Fatal(err)
+		}
+		//
+		db.Close()
+	}
+	//
+	db := NewSQLiteDB(WithName(t.Name()), WithBackup(backup, 1), WithEncryption("fedcba9876543210"))
+	//
+	defer db.Close()
+	//
+	if _, err := db.GetConn(); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := db.StartBackup(false); !errors.Is(err, EBackupKey) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	//
+	if _, generation := db.Restored(); -1 != generation {
+		t.Fatalf("restored generation %d with a wrong key", generation)
+	}
+}
@@ -0,0 +1,355 @@
+package udp_relay
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elitah/utils/atomic"
+)
+
+const (
+	// 按顺序轮流选择上游
+	BalanceRoundRobin = iota
+	// 按权重平滑轮询
+	BalanceWeighted
+	// 按客户端IP一致性哈希，同一客户端总是选择同一上游，上游变化时只影响少量客户端
+	BalanceHash
+	// 按列表顺序选择第一个可用的上游，不可用时切换到下一个
+	BalanceFailover
+)
+
+const (
+	// 一致性哈希中每个权重单位对应的虚拟节点数
+	balanceReplicas = 64
+
+	// 默认的健康检查参数
+	balanceMaxErrors = 3
+	balanceRetry     = 30 * time.Second
+)
+
+type Upstream struct {
+	Address string
+	Weight  int
+}
+
+// 以相同权重将地址列表转为上游列表
+func Upstreams(addrs ...string) []Upstream {
+	list := make([]Upstream, 0, len(addrs))
+	//
+	for _, item := range addrs {
+		list = append(list, Upstream{
+			Address: item,
+			Weight:  1,
+		})
+	}
+	//
+	return list
+}
+
+type upstream struct {
+	Upstream
+
+	b *Balancer
+
+	// 平滑加权轮询的当前权重，由Balancer的锁保护
+	current int
+
+	// 自上次收到上游数据以来的发送错误数
+	errs atomic.AUint64
+
+	// 标记为不可用的时间
+	tm_down atomic.AInt64
+
+	cnt_dial atomic.AUint64
+}
+
+// 发送错误达到上限时标记为不可用
+func (this *upstream) fail() {
+	if max := this.b.max.Load(); 0 < max && max <= this.errs.Add(1) {
+		//
+		now := time.Now().UnixNano()
+		// 重试期间再次出错时重新计时
+		if down := this.tm_down.Load(); 0 == down || this.available(now) {
+			if this.tm_down.CAS(down, now) && 0 == down {
+				this.b.report(fmt.Errorf("upstream %s marked down after %d send errors", this.Address, max))
+			}
+		}
+	}
+}
+
+// 收到上游数据说明上游可用
+func (this *upstream) alive() {
+	if 0 != this.errs.Load() || 0 != this.tm_down.Load() {
+		this.errs.Store(0)
+		this.tm_down.Store(0)
+	}
+}
+
+func (this *upstream) available(now int64) bool {
+	if down := this.tm_down.Load(); 0 != down {
+		// 超过重试时间后重新尝试
+		return time.Duration(now-down) >= time.Duration(this.b.retry.Load())
+	}
+	return true
+}
+
+type ringNode struct {
+	hash uint32
+	u    *upstream
+}
+
+type Balancer struct {
+	sync.Mutex
+
+	policy int
+
+	list []*upstream
+	ring []ringNode
+
+	next atomic.AUint32
+
+	max   atomic.AUint64
+	retry atomic.AInt64
+
+	f func(error)
+}
+
+// 创建上游选择器，Dial方法可直接作为NewUDPTransmission的f0
+// 默认同一上游发送错误3次后标记为不可用，30秒后重新尝试，可通过SetHealthCheck修改
+func NewBalancer(policy int, upstreams ...Upstream) *Balancer {
+	if 0 < len(upstreams) {
+		//
+		b := &Balancer{
+			policy: policy,
+		}
+		//
+		b.max.Store(balanceMaxErrors)
+		b.retry.Store(int64(balanceRetry))
+		//
+		for _, item := range upstreams {
+			//
+			if 0 >= item.Weight {
+				item.Weight = 1
+			}
+			//
+			b.list = append(b.list, &upstream{
+				Upstream: item,
+				b:        b,
+			})
+		}
+		//
+		if BalanceHash == policy {
+			//
+			for _, item := range b.list {
+				for i := 0; item.Weight*balanceReplicas > i; i++ {
+					b.ring = append(b.ring, ringNode{
+						hash: balanceHash(fmt.Sprintf("%s#%d", item.Address, i)),
+						u:    item,
+					})
+				}
+			}
+			//
+			sort.Slice(b.ring, func(i, j int) bool {
+				return b.ring[i].hash < b.ring[j].hash
+			})
+		}
+		//
+		return b
+	}
+	return nil
+}
+
+// 发送错误达到errors次时标记上游不可用，retry后重新尝试，errors为0时不做健康检查
+func (this *Balancer) SetHealthCheck(errors uint64, retry time.Duration) {
+	this.max.Store(errors)
+	this.retry.Store(int64(retry))
+}
+
+// 上游状态变化时回调
+func (this *Balancer) SetErrorHandlerFunc(fn func(error)) {
+	this.f = fn
+}
+
+func (this *Balancer) report(err error) {
+	if nil != this.f {
+		this.f(err)
+	}
+}
+
+// 为新客户端选择上游并建立连接，可用的上游都无法连接时再尝试不可用的上游
+func (this *Balancer) Dial(address *net.UDPAddr) RelayConn {
+	//
+	order := this.order(address)
+	//
+	now := time.Now().UnixNano()
+	//
+	var down []*upstream
+	//
+	for _, item := range order {
+		if item.available(now) {
+			if conn := this.dial(item); nil != conn {
+				return conn
+			}
+		} else {
+			down = append(down, item)
+		}
+	}
+	//
+	for _, item := range down {
+		if conn := this.dial(item); nil != conn {
+			return conn
+		}
+	}
+	//
+	return nil
+}
+
+func (this *Balancer) dial(u *upstream) RelayConn {
+	if conn, err := net.Dial("udp", u.Address); nil == err {
+		//
+		u.cnt_dial.Add(1)
+		//
+		wc := &wrapConn{
+			Conn:     conn,
+			upstream: u,
+		}
+		//
+		wc.tm_connected.Store(time.Now().Unix())
+		//
+		return wc
+	} else {
+		//
+		u.fail()
+		//
+		this.report(err)
+	}
+	return nil
+}
+
+// 按策略返回尝试的顺序
+func (this *Balancer) order(address *net.UDPAddr) []*upstream {
+	//
+	n := len(this.list)
+	//
+	result := make([]*upstream, 0, n)
+	//
+	switch this.policy {
+	case BalanceRoundRobin:
+		//
+		start := int(this.next.Add(1) - 1)
+		//
+		for i := 0; n > i; i++ {
+			result = append(result, this.list[(start+i)%n])
+		}
+	case BalanceWeighted:
+		//
+		var best *upstream
+		//
+		total := 0
+		//
+		this.Lock()
+		// 平滑加权轮询，与nginx的算法相同
+		for _, item := range this.list {
+			//
+			item.current += item.Weight
+			//
+			total += item.Weight
+			//
+			if nil == best || best.current < item.current {
+				best = item
+			}
+		}
+		//
+		best.current -= total
+		//
+		this.Unlock()
+		//
+		result = append(result, best)
+		//
+		for _, item := range this.list {
+			if best != item {
+				result = append(result, item)
+			}
+		}
+	case BalanceHash:
+		//
+		var key uint32
+		//
+		if nil != address {
+			key = balanceHash(address.IP.String())
+		}
+		//
+		i := sort.Search(len(this.ring), func(i int) bool {
+			return this.ring[i].hash >= key
+		})
+		// 顺时针方向的后续上游作为备选
+		seen := make(map[*upstream]bool)
+		//
+		for j := 0; len(this.ring) > j && n > len(result); j++ {
+			if u := this.ring[(i+j)%len(this.ring)].u; !seen[u] {
+				//
+				seen[u] = true
+				//
+				result = append(result, u)
+			}
+		}
+	default:
+		result = append(result, this.list...)
+	}
+	//
+	return result
+}
+
+// FNV对相近的短字符串分布不均，再做一次混合
+func balanceHash(s string) uint32 {
+	//
+	h := fnv.New64a()
+	//
+	h.Write([]byte(s))
+	//
+	x := h.Sum64()
+	//
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	//
+	return uint32(x)
+}
+
+func (this *Balancer) String() string {
+	var s strings.Builder
+	//
+	now := time.Now().UnixNano()
+	//
+	s.WriteString("--- Balancer ----------------------------------------")
+	//
+	for _, item := range this.list {
+		//
+		state := "up"
+		//
+		if 0 != item.tm_down.Load() {
+			if item.available(now) {
+				state = "retry"
+			} else {
+				state = "down"
+			}
+		}
+		//
+		fmt.Fprintf(
+			&s,
+			"\n%s: [W-%d] %s, [D] %d, [E] %d",
+			item.Address,
+			item.Weight,
+			state,
+			item.cnt_dial.Load(),
+			item.errs.Load(),
+		)
+	}
+	//
+	return s.String()
+}
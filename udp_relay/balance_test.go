@@ -0,0 +1,131 @@
+package udp_relay
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func testOrder(b *Balancer, address *net.UDPAddr) []string {
+	//
+	var list []string
+	//
+	for _, item := range b.order(address) {
+		list = append(list, item.Address)
+	}
+	//
+	return list
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	//
+	b := NewBalancer(BalanceRoundRobin, Upstreams("a", "b", "c")...)
+	//
+	for _, expected := range []string{"[a b c]", "[b c a]", "[c a b]", "[a b c]"} {
+		if result := fmt.Sprint(testOrder(b, nil)); expected != result {
+			t.Fatalf("order %s, expected %s", result, expected)
+		}
+	}
+}
+
+// 平滑加权轮询，权重5:1:1时的选择顺序与nginx相同
+func TestBalancerWeighted(t *testing.T) {
+	//
+	b := NewBalancer(BalanceWeighted, Upstream{"a", 5}, Upstream{"b", 1}, Upstream{"c", 1})
+	//
+	var first []string
+	//
+	for i := 0; 7 > i; i++ {
+		first = append(first, testOrder(b, nil)[0])
+	}
+	//
+	if result := fmt.Sprint(first); "[a a b a c a a]" != result {
+		t.Fatalf("order %s", result)
+	}
+}
+
+// 同一客户端IP总是得到相同的顺序，移除一个上游只影响原来选择它的客户端
+func TestBalancerHash(t *testing.T) {
+	//
+	b1 := NewBalancer(BalanceHash, Upstreams("a", "b", "c")...)
+	b2 := NewBalancer(BalanceHash, Upstreams("a", "b")...)
+	//
+	count := make(map[string]int)
+	//
+	for i := 0; 1000 > i; i++ {
+		//
+		address := &net.UDPAddr{
+			IP:   net.IPv4(10, 0, byte(i/256), byte(i%256)),
+			Port: 1000 + i,
+		}
+		//
+		order := testOrder(b1, address)
+		//
+		if 3 != len(order) {
+			t.Fatalf("order %v", order)
+		}
+		// 端口不影响选择
+		if other := testOrder(b1, &net.UDPAddr{IP: address.IP, Port: 1}); fmt.Sprint(order) != fmt.Sprint(other) {
+			t.Fatalf("order %v, expected %v", other, order)
+		}
+		//
+		count[order[0]]++
+		//
+		if "c" != order[0] {
+			if result := testOrder(b2, address)[0]; order[0] != result {
+				t.Fatalf("client %v moved from %s to %s", address, order[0], result)
+			}
+		}
+	}
+	//
+	for _, item := range []string{"a", "b", "c"} {
+		if 200 > count[item] {
+			t.Fatalf("unbalanced distribution %v", count)
+		}
+	}
+}
+
+// 按列表顺序选择，不可用的上游排在可用的上游之后尝试，恢复后重新优先选择
+func TestBalancerFailover(t *testing.T) {
+	//
+	b := NewBalancer(BalanceFailover, Upstreams("127.0.0.1:10001", "127.0.0.1:10002", "127.0.0.1:10003")...)
+	//
+	b.SetHealthCheck(1, time.Hour)
+	//
+	dial := func(expected string) {
+		//
+		conn := b.Dial(nil)
+		//
+		if nil == conn {
+			t.Fatal("unable dial")
+		}
+		//
+		defer conn.Close()
+		//
+		if result := conn.(*wrapConn).RemoteAddr().String(); expected != result {
+			t.Fatalf("dialed %s, expected %s", result, expected)
+		}
+	}
+	//
+	dial("127.0.0.1:10001")
+	dial("127.0.0.1:10001")
+	//
+	b.list[0].fail()
+	//
+	dial("127.0.0.1:10002")
+	//
+	b.list[1].fail()
+	//
+	dial("127.0.0.1:10003")
+	// 全部不可用时仍按顺序尝试
+	b.list[2].fail()
+	//
+	dial("127.0.0.1:10001")
+	//
+	b.list[0].alive()
+	b.list[1].alive()
+	b.list[2].alive()
+	//
+	dial("127.0.0.1:10001")
+}
@@ -0,0 +1,160 @@
+package udp_relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ENoUpstream = errors.New("no upstream address be provided")
+)
+
+// 独立的UDP端口转发服务，每个客户端地址对应一个到上游的会话
+type UDPForwarder struct {
+	conn  *net.UDPConn
+	relay RelayConn
+
+	b *Balancer
+
+	u *UDPTransmission
+
+	flag uint32
+
+	// 读取协程因错误退出的原因
+	err atomic.Value
+
+	wg sync.WaitGroup
+}
+
+// 在address上监听，新客户端按轮询选择上游，连接失败时尝试下一个，会话空闲timeout后关闭
+func NewUDPForwarder(address string, upstreams []string, timeout time.Duration, opts ...Option) (*UDPForwarder, error) {
+	return NewUDPForwarderWithBalancer(address, NewBalancer(BalanceRoundRobin, Upstreams(upstreams...)...), timeout, opts...)
+}
+
+// 由b为新客户端选择上游
+func NewUDPForwarderWithBalancer(address string, b *Balancer, timeout time.Duration, opts ...Option) (*UDPForwarder, error) {
+	//
+	if nil == b {
+		return nil, ENoUpstream
+	}
+	//
+	addr, err := net.ResolveUDPAddr("udp", address)
+	//
+	if nil != err {
+		return nil, err
+	}
+	//
+	conn, err := net.ListenUDP("udp", addr)
+	//
+	if nil != err {
+		return nil, err
+	}
+	//
+	f := &UDPForwarder{
+		conn:  conn,
+		relay: NewWrapConn(conn),
+		b:     b,
+	}
+	//
+	if f.u = NewUDPTransmission(timeout, b.Dial, f.reply, opts...); nil == f.u {
+		//
+		conn.Close()
+		//
+		return nil, fmt.Errorf("unable create udp transmission")
+	}
+	//
+	f.wg.Add(1)
+	//
+	go f.loopRead()
+	//
+	return f, nil
+}
+
+// 实际监听的地址，监听端口为0时可以获取分配的端口
+func (this *UDPForwarder) Addr() net.Addr {
+	return this.conn.LocalAddr()
+}
+
+func (this *UDPForwarder) SetErrorHandlerFunc(fn func(error)) {
+	this.b.SetErrorHandlerFunc(fn)
+	this.u.SetErrorHandlerFunc(fn)
+}
+
+// 监听连接出错导致转发停止时返回原因，正常运行或已关闭时返回nil
+func (this *UDPForwarder) Err() error {
+	if err, ok := this.err.Load().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (this *UDPForwarder) String() string {
+	if err := this.Err(); nil != err {
+		return fmt.Sprintf("%v (down: %v)\n%s\n%s", this.conn.LocalAddr(), err, this.b, this.u)
+	}
+	return fmt.Sprintf("%v\n%s\n%s", this.conn.LocalAddr(), this.b, this.u)
+}
+
+func (this *UDPForwarder) reply(p *UDPPacket) {
+	this.relay.WriteTo(p.Data[:p.Length], p.Address)
+}
+
+func (this *UDPForwarder) loopRead() {
+	//
+	defer this.wg.Done()
+	//
+	for {
+		//
+		p, err := this.u.ReadPacket(this.conn)
+		//
+		if nil != err {
+			//
+			if 0x0 != atomic.LoadUint32(&this.flag) {
+				return
+			}
+			// 临时错误稍后继续读取，其余错误(如连接被关闭)无法继续转发
+			if _err, ok := err.(net.Error); ok && _err.Temporary() {
+				//
+				time.Sleep(10 * time.Millisecond)
+				//
+				continue
+			}
+			//
+			this.err.Store(fmt.Errorf("udp forwarder %v stopped, %w", this.conn.LocalAddr(), err))
+			//
+			this.u.report(this.Err())
+			//
+			return
+		}
+		//
+		if 0 == p.Length || !this.u.Forward(p) {
+			this.u.PutUDPPacket(p)
+		}
+	}
+}
+
+// 停止监听，等待读取协程退出后关闭所有会话
+func (this *UDPForwarder) Close() error {
+	return this.Shutdown(context.Background())
+}
+
+func (this *UDPForwarder) Shutdown(ctx context.Context) error {
+	if atomic.CompareAndSwapUint32(&this.flag, 0x0, 0x1) {
+		//
+		err := this.conn.Close()
+		//
+		this.wg.Wait()
+		//
+		if _err := this.u.Shutdown(ctx); nil == err {
+			err = _err
+		}
+		//
+		return err
+	}
+	return nil
+}
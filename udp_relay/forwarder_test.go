@@ -0,0 +1,43 @@
+package udp_relay
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// 监听连接被意外关闭时通过回调报告，并在状态中显示
+func TestForwarderReadError(t *testing.T) {
+	//
+	f, err := NewUDPForwarder("127.0.0.1:0", []string{"127.0.0.1:10001"}, time.Second)
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer f.Close()
+	//
+	ch := make(chan error, 1)
+	//
+	f.SetErrorHandlerFunc(func(err error) {
+		select {
+		case ch <- err:
+		default:
+		}
+	})
+	//
+	f.conn.Close()
+	//
+	select {
+	case err := <-ch:
+		if !strings.Contains(err.Error(), "use of closed network connection") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("error not reported")
+	}
+	//
+	if nil == f.Err() || !strings.Contains(f.String(), "down") {
+		t.Fatalf("forwarder not marked down: %s", f)
+	}
+}
@@ -0,0 +1,215 @@
+package udp_relay
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// 超出限制时直接丢弃
+	LimitDrop = iota
+	// 超出限制时丢弃并通过SetErrorHandlerFunc设置的回调报告
+	LimitReport
+)
+
+var (
+	ERateLimited     = errors.New("rate limit exceeded")
+	ETooManySessions = errors.New("too many sessions")
+)
+
+// 令牌桶，容量为1秒的速率
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+
+	last time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if burst < rate {
+		burst = rate
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+	}
+}
+
+func (this *tokenBucket) fill(now time.Time) {
+	//
+	if !this.last.IsZero() {
+		if this.tokens += now.Sub(this.last).Seconds() * this.rate; this.burst < this.tokens {
+			this.tokens = this.burst
+		}
+	}
+	//
+	this.last = now
+}
+
+type rateLimit struct {
+	pps float64
+	bps float64
+}
+
+func (this rateLimit) enabled() bool {
+	return 0 < this.pps || 0 < this.bps
+}
+
+// 同时限制包数及字节数
+type limiter struct {
+	packets *tokenBucket
+	bytes   *tokenBucket
+}
+
+func newLimiter(l rateLimit, mtu int) *limiter {
+	//
+	r := &limiter{}
+	//
+	if 0 < l.pps {
+		r.packets = newTokenBucket(l.pps, 1)
+	}
+	// 至少允许一个最大长度的数据包通过
+	if 0 < l.bps {
+		r.bytes = newTokenBucket(l.bps, float64(mtu))
+	}
+	//
+	return r
+}
+
+// 两个桶都有足够的令牌时返回true，不扣除
+func (this *limiter) check(now time.Time, size int) bool {
+	//
+	if nil != this.packets {
+		//
+		this.packets.fill(now)
+		//
+		if 1 > this.packets.tokens {
+			return false
+		}
+	}
+	//
+	if nil != this.bytes {
+		//
+		this.bytes.fill(now)
+		//
+		if float64(size) > this.bytes.tokens {
+			return false
+		}
+	}
+	//
+	return true
+}
+
+func (this *limiter) take(size int) {
+	//
+	if nil != this.packets {
+		this.packets.tokens -= 1
+	}
+	//
+	if nil != this.bytes {
+		this.bytes.tokens -= float64(size)
+	}
+}
+
+// 限制每个客户端地址发往上游的速率，pps为每秒包数，bps为每秒字节数，0表示不限制
+func WithClientLimit(pps, bps float64) Option {
+	return func(u *UDPTransmission) {
+		u.limit_client = rateLimit{
+			pps: pps,
+			bps: bps,
+		}
+	}
+}
+
+// 限制所有客户端发往上游的总速率
+func WithGlobalLimit(pps, bps float64) Option {
+	return func(u *UDPTransmission) {
+		u.limit_global = rateLimit{
+			pps: pps,
+			bps: bps,
+		}
+	}
+}
+
+// 同时存在的会话数上限，达到上限后新客户端的数据包被丢弃
+func WithMaxSessions(n int) Option {
+	return func(u *UDPTransmission) {
+		if 0 <= n {
+			u.max_sessions = n
+		}
+	}
+}
+
+// 超出限制时的处理方式: LimitDrop、LimitReport
+func WithLimitPolicy(policy int) Option {
+	return func(u *UDPTransmission) {
+		u.limit_policy = policy
+	}
+}
+
+// 因超出速率或会话数限制被丢弃的数据包数
+func (this *UDPTransmission) Limited() uint64 {
+	return this.cnt_limited.Load()
+}
+
+// 检查客户端发往上游的数据包，调用者需持有锁
+// 依次检查会话数、客户端及全局速率，全部通过后才扣除令牌并保存客户端的限速状态
+func (this *UDPTransmission) allow(token string, size int, now time.Time) error {
+	//
+	if 0 < this.max_sessions && this.max_sessions <= len(this.m)+len(this.dialing) {
+		// 已有会话或正在建立会话的客户端不受影响
+		if _, ok := this.m[token]; !ok {
+			if _, ok := this.dialing[token]; !ok {
+				return fmt.Errorf("%w, max %d, client %s", ETooManySessions, this.max_sessions, token)
+			}
+		}
+	}
+	//
+	var l *limiter
+	//
+	stored := false
+	//
+	if this.limit_client.enabled() {
+		// 数据包被接受后才保存，被拒绝的伪造地址不会占用内存
+		if l, stored = this.l[token]; !stored {
+			l = newLimiter(this.limit_client, this.mtu)
+		}
+		//
+		if !l.check(now, size) {
+			return fmt.Errorf("%w, client %s", ERateLimited, token)
+		}
+	}
+	// 全部检查通过后才扣除令牌，被全局限制拒绝的数据包不消耗客户端的令牌
+	if nil != this.global {
+		//
+		if !this.global.check(now, size) {
+			return fmt.Errorf("%w, global, client %s", ERateLimited, token)
+		}
+		//
+		this.global.take(size)
+	}
+	// 会话结束或建立失败时删除
+	if nil != l {
+		//
+		l.take(size)
+		//
+		if !stored {
+			this.l[token] = l
+		}
+	}
+	//
+	return nil
+}
+
+// 由loopSend调用，不能经过e通道，否则通道满时会阻塞自身
+func (this *UDPTransmission) exceed(err error) {
+	//
+	this.cnt_limited.Add(1)
+	//
+	if LimitReport == this.limit_policy && nil != this.f2 {
+		this.f2(err)
+	}
+}
@@ -0,0 +1,98 @@
+package udp_relay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func testTransmission(t *testing.T, opts ...Option) *UDPTransmission {
+	//
+	u := NewUDPTransmission(time.Second, func(*net.UDPAddr) RelayConn {
+		return nil
+	}, func(*UDPPacket) {}, opts...)
+	//
+	if nil == u {
+		t.Fatal("unable create udp transmission")
+	}
+	//
+	return u
+}
+
+// 被会话数或全局速率拒绝的数据包不能在限速表中留下记录
+func TestLimiterRejectedNotStored(t *testing.T) {
+	//
+	u := testTransmission(t, WithClientLimit(10, 0), WithGlobalLimit(1, 0))
+	//
+	defer u.Close()
+	//
+	now := time.Now()
+	//
+	u.Lock()
+	defer u.Unlock()
+	//
+	if err := u.allow("10.0.0.1:1", 100, now); nil != err {
+		t.Fatal(err)
+	}
+	// 全局令牌已用完，伪造地址的数据包全部被拒绝
+	for i := 0; 10000 > i; i++ {
+		if err := u.allow(fmt.Sprintf("10.0.%d.%d:2", i/256, i%256), 100, now); !errors.Is(err, ERateLimited) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	//
+	if 1 != len(u.l) {
+		t.Fatalf("%d limiters stored, expected 1", len(u.l))
+	}
+}
+
+func TestLimiterSessionCapNotStored(t *testing.T) {
+	//
+	u := testTransmission(t, WithClientLimit(10, 0), WithMaxSessions(1))
+	//
+	defer u.Close()
+	//
+	now := time.Now()
+	//
+	u.Lock()
+	defer u.Unlock()
+	//
+	u.dialing["10.0.0.1:1"] = nil
+	//
+	for i := 0; 1000 > i; i++ {
+		if err := u.allow(fmt.Sprintf("10.0.%d.%d:2", i/256, i%256), 100, now); !errors.Is(err, ETooManySessions) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	//
+	if 0 != len(u.l) {
+		t.Fatalf("%d limiters stored, expected 0", len(u.l))
+	}
+}
+
+// 被全局速率拒绝时不扣除客户端的令牌
+func TestLimiterGlobalRejectKeepsClientTokens(t *testing.T) {
+	//
+	u := testTransmission(t, WithClientLimit(2, 0), WithGlobalLimit(1, 0))
+	//
+	defer u.Close()
+	//
+	now := time.Now()
+	//
+	u.Lock()
+	defer u.Unlock()
+	//
+	if err := u.allow("10.0.0.1:1", 100, now); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if err := u.allow("10.0.0.1:1", 100, now); !errors.Is(err, ERateLimited) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	//
+	if tokens := u.l["10.0.0.1:1"].packets.tokens; 1 != tokens {
+		t.Fatalf("client has %v tokens, expected 1", tokens)
+	}
+}
@@ -0,0 +1,99 @@
+package udp_relay
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// 会话统计，发送指客户端到上游方向，接收指上游到客户端方向
+type SessionStats struct {
+	Client   string `json:"client"`
+	Upstream string `json:"upstream"`
+
+	Connected time.Time `json:"connected"`
+	LastSend  time.Time `json:"last_send"`
+	LastRecv  time.Time `json:"last_recv"`
+
+	BytesSent   uint64 `json:"bytes_sent"`
+	PacketsSent uint64 `json:"packets_sent"`
+	BytesRecv   uint64 `json:"bytes_recv"`
+	PacketsRecv uint64 `json:"packets_recv"`
+
+	ErrorsSend uint64 `json:"errors_send"`
+	ErrorsRecv uint64 `json:"errors_recv"`
+}
+
+// 会话结束时以最终统计回调，在会话的接收协程中调用，不能长时间阻塞
+func WithSessionEnd(fn func(SessionStats)) Option {
+	return func(u *UDPTransmission) {
+		u.f3 = fn
+	}
+}
+
+func unixTime(sec int64) time.Time {
+	if 0 < sec {
+		return time.Unix(sec, 0)
+	}
+	return time.Time{}
+}
+
+func (this *wrapConn) Stats() SessionStats {
+	return SessionStats{
+		Connected:   unixTime(this.tm_connected.Load()),
+		LastSend:    unixTime(this.tm_data_send.Load()),
+		LastRecv:    unixTime(this.tm_data_recv.Load()),
+		BytesSent:   this.cnt_data_send.Load(),
+		PacketsSent: this.cnt_pkg_send.Load(),
+		BytesRecv:   this.cnt_data_recv.Load(),
+		PacketsRecv: this.cnt_pkg_recv.Load(),
+		ErrorsSend:  this.cnt_err_send.Load(),
+		ErrorsRecv:  this.cnt_err_recv.Load(),
+	}
+}
+
+// 自定义的RelayConn没有统计时只返回地址
+func sessionStats(token string, conn net.Conn) SessionStats {
+	//
+	var stats SessionStats
+	//
+	if s, ok := conn.(interface {
+		Stats() SessionStats
+	}); ok {
+		stats = s.Stats()
+	}
+	//
+	if addr := conn.RemoteAddr(); nil != addr {
+		stats.Upstream = addr.String()
+	}
+	//
+	stats.Client = token
+	//
+	return stats
+}
+
+// 当前所有会话的统计，按客户端地址排序
+func (this *UDPTransmission) Sessions() []SessionStats {
+	//
+	this.Lock()
+	//
+	list := make([]SessionStats, 0, len(this.m))
+	//
+	for token, conn := range this.m {
+		list = append(list, sessionStats(token, conn))
+	}
+	//
+	this.Unlock()
+	//
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Client < list[j].Client
+	})
+	//
+	return list
+}
+
+func (this *UDPTransmission) sessionEnd(token string, conn net.Conn) {
+	if nil != this.f3 {
+		this.f3(sessionStats(token, conn))
+	}
+}
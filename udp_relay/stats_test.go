@@ -0,0 +1,53 @@
+package udp_relay
+
+import (
+	"testing"
+	"time"
+)
+
+// 会话统计按方向计数，会话结束时以最终统计回调
+func TestSessionStats(t *testing.T) {
+	//
+	echo := testEchoServer(t)
+	//
+	defer echo.Close()
+	//
+	ch := make(chan SessionStats, 1)
+	//
+	f, err := NewUDPForwarder("127.0.0.1:0", []string{echo.LocalAddr().String()}, time.Second, WithSessionEnd(func(stats SessionStats) {
+		ch <- stats
+	}))
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer f.Close()
+	//
+	conn, _ := testRoundTrip(t, f, []byte("hello"))
+	//
+	defer conn.Close()
+	//
+	list := f.u.Sessions()
+	//
+	if 1 != len(list) {
+		t.Fatalf("%d sessions", len(list))
+	}
+	//
+	if stats := list[0]; conn.LocalAddr().String() != stats.Client || echo.LocalAddr().String() != stats.Upstream {
+		t.Fatalf("unexpected session %+v", stats)
+	} else if 1 != stats.PacketsSent || 5 != stats.BytesSent || 1 != stats.PacketsRecv || 5 != stats.BytesRecv || stats.Connected.IsZero() {
+		t.Fatalf("unexpected session %+v", stats)
+	}
+	//
+	f.Close()
+	//
+	select {
+	case stats := <-ch:
+		if conn.LocalAddr().String() != stats.Client || 1 != stats.PacketsSent || 1 != stats.PacketsRecv {
+			t.Fatalf("unexpected session %+v", stats)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session end not reported")
+	}
+}
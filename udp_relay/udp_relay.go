@@ -1,6 +1,7 @@
 package udp_relay
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,11 +12,13 @@ import (
 	"time"
 
 	"github.com/elitah/utils/atomic"
+	"github.com/elitah/utils/bufferpool"
 )
 
 var (
 	ENoReady   = errors.New("connection not ready")
 	ENoAddress = errors.New("no address could be access")
+	EClosed    = errors.New("transmission was closed")
 )
 
 type RelayConn interface {
@@ -44,6 +47,9 @@ type wrapConn struct {
 
 	cnt_err_send atomic.AUint64
 	cnt_err_recv atomic.AUint64
+
+	// 由Balancer建立的连接，发送错误计入上游的健康检查
+	upstream *upstream
 }
 
 func NewWrapConn(conn net.Conn, addrs ...net.Addr) RelayConn {
@@ -72,6 +78,10 @@ func (this *wrapConn) Read(data []byte) (n int, err error) {
 		this.cnt_data_recv.Add(uint64(n))
 		//
 		this.cnt_pkg_recv.Add(1)
+		//
+		if nil != this.upstream {
+			this.upstream.alive()
+		}
 	}
 	//
 	if nil != err {
@@ -95,7 +105,12 @@ func (this *wrapConn) Write(data []byte) (n int, err error) {
 	}
 	//
 	if nil != err {
+		//
 		this.cnt_err_send.Add(1)
+		//
+		if nil != this.upstream {
+			this.upstream.fail()
+		}
 	}
 	//
 	return
@@ -123,6 +138,10 @@ func (this *wrapConn) WriteTo(data []byte, addr net.Addr) (n int, err error) {
 	if nil != err {
 		//
 		this.cnt_err_send.Add(1)
+		//
+		if nil != this.upstream {
+			this.upstream.fail()
+		}
 	}
 	//
 	return
@@ -154,7 +173,7 @@ func (this *wrapConn) String() string {
 	return fmt.Sprintf(
 		"%v: [S]: [A-%v:S-%ds:R-%ds] %d(%d), [R]: %d(%d), [E] %d | %d",
 		this.RemoteAddr(),
-		time.Duration(unixnow-this.tm_connected.Load()) * time.Second,
+		time.Duration(unixnow-this.tm_connected.Load())*time.Second,
 		unixnow-this.tm_data_send.Load(),
 		unixnow-this.tm_data_recv.Load(),
 		this.cnt_data_send.Load(),
@@ -164,8 +183,49 @@ func (this *wrapConn) String() string {
 		this.cnt_err_send.Load(),
 		this.cnt_err_recv.Load(),
 	)
+}
+
+const (
+	// 默认的数据包最大长度
+	DefaultMTU = 1024
+
+	// 建立会话期间暂存的数据包数
+	dialQueueMax = 64
+
+	// UDP数据包的最大长度
+	MaxMTU = 65535
+)
+
+var (
+	// 按缓冲区长度(KiB)共享的缓冲池
+	pools sync.Map
+)
+
+type Option func(*UDPTransmission)
+
+// 单个数据包的最大长度，最大为64KiB，超出的数据包被截断并计入Truncated
+func WithMTU(n int) Option {
+	return func(u *UDPTransmission) {
+		if 0 < n {
+			if MaxMTU < n {
+				n = MaxMTU
+			}
+			u.mtu = n
+		}
+	}
+}
+
+func getBufferPool(size int) *bufferpool.BufferPool {
+	//
+	n := (size + 1023) / 1024
+	//
+	if p, ok := pools.Load(n); ok {
+		return p.(*bufferpool.BufferPool)
+	}
 	//
-	return ""
+	p, _ := pools.LoadOrStore(n, bufferpool.NewBufferPool(n))
+	//
+	return p.(*bufferpool.BufferPool)
 }
 
 type UDPPacket struct {
@@ -173,10 +233,14 @@ type UDPPacket struct {
 
 	Address *net.UDPAddr
 
-	Data   [1024]byte
+	// 长度为MTU，底层缓冲区多出一个字节用于检测截断
+	// 不兼容旧版本的[1024]byte，缓冲区来自缓冲池，PutUDPPacket后不能再使用
+	Data   []byte
 	Length int
 
 	incoming bool
+
+	b *bufferpool.Buffer
 }
 
 func (this *UDPPacket) Reset() {
@@ -188,12 +252,41 @@ func (this *UDPPacket) Reset() {
 	this.incoming = false
 }
 
+// 读取时多提供一个字节，读满时说明数据包超出MTU
+func (this *UDPPacket) buffer() []byte {
+	if len(this.Data) < cap(this.Data) {
+		return this.Data[:len(this.Data)+1]
+	}
+	return this.Data
+}
+
 type UDPTransmission struct {
 	sync.Mutex
 
+	// 保护c0的发送与关闭
+	rw sync.RWMutex
+
 	p *sync.Pool
 
+	mtu  int
+	pool *bufferpool.BufferPool
+
+	cnt_truncated atomic.AUint64
+	cnt_limited   atomic.AUint64
+
+	limit_client rateLimit
+	limit_global rateLimit
+	limit_policy int
+
+	max_sessions int
+
+	// 正在建立连接的会话，以及期间收到的数据包
+	dialing map[string][]*UDPPacket
+
+	global *limiter
+
 	m map[string]RelayConn
+	l map[string]*limiter
 
 	c0 chan *UDPPacket
 	c1 chan string
@@ -205,9 +298,16 @@ type UDPTransmission struct {
 	f0 func(*net.UDPAddr) RelayConn
 	f1 func(*UDPPacket)
 	f2 func(error)
+	f3 func(SessionStats)
+
+	flag atomic.AUint32
+
+	done chan struct{}
+
+	wg sync.WaitGroup
 }
 
-func NewUDPTransmission(t time.Duration, f0 func(*net.UDPAddr) RelayConn, f1 func(*UDPPacket)) *UDPTransmission {
+func NewUDPTransmission(t time.Duration, f0 func(*net.UDPAddr) RelayConn, f1 func(*UDPPacket), opts ...Option) *UDPTransmission {
 	if nil != f0 && nil != f1 {
 		if p := (&sync.Pool{
 			New: func() interface{} {
@@ -222,16 +322,35 @@ func NewUDPTransmission(t time.Duration, f0 func(*net.UDPAddr) RelayConn, f1 fun
 			//fmt.Println(t)
 			//
 			u := &UDPTransmission{
-				p:  p,
-				m:  make(map[string]RelayConn),
-				c0: make(chan *UDPPacket, 1024),
-				c1: make(chan string),
-				e:  make(chan error, 32),
-				t:  t,
-				f0: f0,
-				f1: f1,
+				p:   p,
+				mtu: DefaultMTU,
+				m:   make(map[string]RelayConn),
+				l:   make(map[string]*limiter),
+
+				dialing: make(map[string][]*UDPPacket),
+				c0:      make(chan *UDPPacket, 1024),
+				c1:      make(chan string),
+				e:       make(chan error, 32),
+				t:       t,
+				f0:      f0,
+				f1:      f1,
+				done:    make(chan struct{}),
 			}
 			//
+			for _, opt := range opts {
+				if nil != opt {
+					opt(u)
+				}
+			}
+			//
+			u.pool = getBufferPool(u.mtu + 1)
+			//
+			if u.limit_global.enabled() {
+				u.global = newLimiter(u.limit_global, u.mtu)
+			}
+			//
+			u.wg.Add(1)
+			//
 			go u.loopSend()
 			//
 			return u
@@ -245,10 +364,24 @@ func (this *UDPTransmission) SetErrorHandlerFunc(fn func(error)) {
 }
 
 func (this *UDPTransmission) GetUDPPacket() *UDPPacket {
-	if p, ok := this.p.Get().(*UDPPacket); ok {
-		return p
+	//
+	p, ok := this.p.Get().(*UDPPacket)
+	//
+	if !ok {
+		p = &UDPPacket{}
 	}
-	return &UDPPacket{}
+	//
+	if b := this.pool.Get(); nil != b {
+		//
+		b.Grow(this.mtu + 1)
+		//
+		p.b = b
+		p.Data = b.Bytes()[:this.mtu]
+	} else {
+		p.Data = make([]byte, this.mtu, this.mtu+1)
+	}
+	//
+	return p
 }
 
 func (this *UDPTransmission) PutUDPPacket(p *UDPPacket) {
@@ -256,23 +389,152 @@ func (this *UDPTransmission) PutUDPPacket(p *UDPPacket) {
 		//
 		p.Reset()
 		//
+		if nil != p.b {
+			//
+			p.b.Free()
+			//
+			p.b = nil
+		}
+		//
+		p.Data = nil
+		//
 		this.p.Put(p)
 	}
 }
 
+func (this *UDPTransmission) MTU() int {
+	return this.mtu
+}
+
+// 因超出MTU被截断的数据包数
+func (this *UDPTransmission) Truncated() uint64 {
+	return this.cnt_truncated.Load()
+}
+
+func (this *UDPTransmission) truncate(p *UDPPacket, n int) int {
+	if len(p.Data) < n {
+		//
+		this.cnt_truncated.Add(1)
+		//
+		return len(p.Data)
+	}
+	return n
+}
+
+// 从监听的连接读取一个数据包，超出MTU时截断并计入Truncated
+func (this *UDPTransmission) ReadPacket(conn *net.UDPConn) (*UDPPacket, error) {
+	//
+	p := this.GetUDPPacket()
+	//
+	if n, addr, err := conn.ReadFromUDP(p.buffer()); nil == err {
+		//
+		p.Address = addr
+		p.Length = this.truncate(p, n)
+		//
+		return p, nil
+	} else {
+		//
+		this.PutUDPPacket(p)
+		//
+		return nil, err
+	}
+}
+
 func (this *UDPTransmission) Forward(p *UDPPacket) bool {
 	if nil != p && nil != p.Address {
 		//
 		p.incoming = false
 		//
-		this.c0 <- p
-		//
-		return true
+		return this.push(p)
 	}
 	//
 	return false
 }
 
+// 关闭后返回false，数据包由调用者处理
+func (this *UDPTransmission) push(p *UDPPacket) bool {
+	//
+	this.rw.RLock()
+	defer this.rw.RUnlock()
+	//
+	if 0x0 != this.flag.Load() {
+		return false
+	}
+	//
+	select {
+	case this.c0 <- p:
+		return true
+	case <-this.done:
+		return false
+	}
+}
+
+func (this *UDPTransmission) report(err error) {
+	select {
+	case this.e <- err:
+	case <-this.done:
+	}
+}
+
+// 等同于Shutdown(context.Background())
+func (this *UDPTransmission) Close() error {
+	return this.Shutdown(context.Background())
+}
+
+// 停止接收数据包，关闭所有会话并等待协程退出，ctx结束时不再等待并返回ctx.Err()
+func (this *UDPTransmission) Shutdown(ctx context.Context) error {
+	if this.flag.CAS(0x0, 0x1) {
+		//
+		close(this.done)
+		// 关闭连接以打断loopRecv中的读取
+		this.Lock()
+		//
+		for token, conn := range this.m {
+			//
+			conn.Close()
+			//
+			delete(this.m, token)
+		}
+		//
+		this.Unlock()
+		//
+		exit := make(chan struct{})
+		//
+		go func() {
+			//
+			this.wg.Wait()
+			// 等待正在发送的Forward返回后才能关闭通道
+			this.rw.Lock()
+			//
+			for drained := false; !drained; {
+				select {
+				case p := <-this.c0:
+					this.PutUDPPacket(p)
+				default:
+					drained = true
+				}
+			}
+			//
+			close(this.c0)
+			close(this.c1)
+			close(this.e)
+			//
+			this.rw.Unlock()
+			//
+			close(exit)
+		}()
+		//
+		select {
+		case <-exit:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	//
+	return EClosed
+}
+
 func (this *UDPTransmission) String() string {
 	var s strings.Builder
 	//
@@ -284,7 +546,7 @@ func (this *UDPTransmission) String() string {
 	//
 	if n := len(this.m); 0 < n {
 		//
-		list = make([]string, n)
+		list = make([]string, 0, n)
 		//
 		for key, _ := range this.m {
 			list = append(list, key)
@@ -299,15 +561,12 @@ func (this *UDPTransmission) String() string {
 		//
 		this.Lock()
 		//
-		for i, item := range list {
+		for _, item := range list {
 			//
 			if conn, ok := this.m[item]; ok {
-				if 0 < i {
-					s.WriteString("\n")
-				}
 				fmt.Fprintf(
 					&s,
-					"%s <===> %v",
+					"\n%s <===> %v",
 					item,
 					conn.String(),
 				)
@@ -321,6 +580,8 @@ func (this *UDPTransmission) String() string {
 }
 
 func (this *UDPTransmission) loopSend() {
+	//
+	defer this.wg.Done()
 	//
 	var conn RelayConn
 	//
@@ -334,6 +595,17 @@ func (this *UDPTransmission) loopSend() {
 					//
 					this.Lock()
 					//
+					if err := this.allow(token, p.Length, time.Now()); nil != err {
+						//
+						this.Unlock()
+						//
+						this.exceed(err)
+						//
+						this.PutUDPPacket(p)
+						//
+						continue
+					}
+					//
 					if conn, ok = this.m[token]; ok {
 						//
 						if _, err := conn.Write(p.Data[:p.Length]); nil == err {
@@ -343,19 +615,65 @@ func (this *UDPTransmission) loopSend() {
 							//
 							ok = false
 							//
-							this.e <- err
+							this.report(err)
 						}
 					}
 					//
+					// 同一客户端正在建立连接时暂存数据包，避免重复建立会话
+					if list, dialing := this.dialing[token]; !ok && dialing {
+						//
+						if dialQueueMax > len(list) {
+							this.dialing[token] = append(list, p)
+						} else {
+							this.PutUDPPacket(p)
+						}
+						//
+						this.Unlock()
+						//
+						continue
+					}
+					//
+					if !ok {
+						this.dialing[token] = nil
+					}
+					//
 					this.Unlock()
 					//
 					if !ok {
+						//
+						this.wg.Add(1)
 						//
 						go func(token string, p *UDPPacket) {
 							//
-							if _, err := this.newNode(token, p); nil != err {
+							defer this.wg.Done()
+							//
+							_, err := this.newNode(token, p)
+							//
+							this.Lock()
+							//
+							list := this.dialing[token]
+							//
+							delete(this.dialing, token)
+							//
+							conn, ok := this.m[token]
+							// 会话未建立时不再需要该客户端的限速状态
+							if !ok {
+								delete(this.l, token)
+							}
+							//
+							this.Unlock()
+							//
+							for _, item := range list {
+								//
+								if ok && nil == err {
+									conn.Write(item.Data[:item.Length])
+								}
 								//
-								this.e <- err
+								this.PutUDPPacket(item)
+							}
+							//
+							if nil != err {
+								this.report(err)
 							}
 						}(token, p)
 						//
@@ -377,6 +695,7 @@ func (this *UDPTransmission) loopSend() {
 				this.Lock()
 				//
 				delete(this.m, token)
+				delete(this.l, token)
 				//
 				this.Unlock()
 			}
@@ -386,11 +705,17 @@ func (this *UDPTransmission) loopSend() {
 					this.f2(err)
 				}
 			}
+		case <-this.done:
+			return
 		}
 	}
 }
 
 func (this *UDPTransmission) loopRecv(token string, conn net.Conn, address *net.UDPAddr) {
+	//
+	defer this.wg.Done()
+	//
+	defer this.sessionEnd(token, conn)
 	//
 	var err error
 	//
@@ -399,7 +724,9 @@ func (this *UDPTransmission) loopRecv(token string, conn net.Conn, address *net.
 			//
 			conn.SetReadDeadline(time.Now().Add(this.t))
 			//
-			if p.Length, err = conn.Read(p.Data[:]); nil == err {
+			if p.Length, err = conn.Read(p.buffer()); nil == err {
+				//
+				p.Length = this.truncate(p, p.Length)
 				//
 				if 0 < p.Length {
 					//
@@ -407,15 +734,21 @@ func (this *UDPTransmission) loopRecv(token string, conn net.Conn, address *net.
 					//
 					p.incoming = true
 					//
-					this.c0 <- p
+					if this.push(p) {
+						continue
+					}
+					//
+					this.PutUDPPacket(p)
 					//
-					continue
+					conn.Close()
+					//
+					return
 				}
 			} else {
 				//
-				if !errors.Is(err, io.EOF) {
+				if !errors.Is(err, io.EOF) && 0x0 == this.flag.Load() {
 					//
-					this.e <- err
+					this.report(err)
 				}
 				//
 				this.PutUDPPacket(p)
@@ -429,7 +762,10 @@ func (this *UDPTransmission) loopRecv(token string, conn net.Conn, address *net.
 		}
 	}
 	//
-	this.c1 <- token
+	select {
+	case this.c1 <- token:
+	case <-this.done:
+	}
 }
 
 func (this *UDPTransmission) newNode(token string, p *UDPPacket) (int, error) {
@@ -442,9 +778,20 @@ func (this *UDPTransmission) newNode(token string, p *UDPPacket) (int, error) {
 				if n, err := conn.Write(p.Data[:p.Length]); nil == err {
 					//
 					this.Lock()
+					// 建立连接期间已关闭
+					if 0x0 != this.flag.Load() {
+						//
+						this.Unlock()
+						//
+						conn.Close()
+						//
+						return 0, EClosed
+					}
 					//
 					this.m[token] = conn
 					//
+					this.wg.Add(1)
+					//
 					this.Unlock()
 					//
 					go this.loopRecv(token, conn, p.Address)
@@ -0,0 +1,145 @@
+package udp_relay
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// 原样返回收到的数据包
+func testEchoServer(t *testing.T) *net.UDPConn {
+	//
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	go func() {
+		//
+		buf := make([]byte, MaxMTU)
+		//
+		for {
+			if n, addr, err := conn.ReadFromUDP(buf); nil == err {
+				conn.WriteToUDP(buf[:n], addr)
+			} else {
+				return
+			}
+		}
+	}()
+	//
+	return conn
+}
+
+// 通过转发服务发送data，返回收到的回复
+func testRoundTrip(t *testing.T, f *UDPForwarder, data []byte) (*net.UDPConn, []byte) {
+	//
+	conn, err := net.DialUDP("udp", nil, f.Addr().(*net.UDPAddr))
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	if _, err := conn.Write(data); nil != err {
+		t.Fatal(err)
+	}
+	//
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	//
+	buf := make([]byte, MaxMTU)
+	//
+	if n, err := conn.Read(buf); nil == err {
+		return conn, buf[:n]
+	} else {
+		t.Fatal(err)
+	}
+	//
+	return nil, nil
+}
+
+// 关闭后会话被关闭，不再接收数据包，重复关闭返回EClosed
+func TestShutdownDrain(t *testing.T) {
+	//
+	echo := testEchoServer(t)
+	//
+	defer echo.Close()
+	//
+	f, err := NewUDPForwarder("127.0.0.1:0", []string{echo.LocalAddr().String()}, time.Second)
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	conn, reply := testRoundTrip(t, f, []byte("hello"))
+	//
+	defer conn.Close()
+	//
+	if "hello" != string(reply) || 1 != len(f.u.Sessions()) {
+		t.Fatalf("reply %q, %d sessions", reply, len(f.u.Sessions()))
+	}
+	//
+	if err := f.Close(); nil != err {
+		t.Fatal(err)
+	}
+	//
+	if 0 != len(f.u.Sessions()) {
+		t.Fatalf("%d sessions left", len(f.u.Sessions()))
+	}
+	//
+	p := f.u.GetUDPPacket()
+	//
+	p.Address = conn.LocalAddr().(*net.UDPAddr)
+	//
+	if f.u.Forward(p) {
+		t.Fatal("packet accepted after shutdown")
+	}
+	//
+	f.u.PutUDPPacket(p)
+	//
+	if err := f.u.Close(); !errors.Is(err, EClosed) {
+		t.Fatalf("unexpected result %v", err)
+	}
+	//
+	if err := f.Close(); nil != err {
+		t.Fatal(err)
+	}
+}
+
+// 超出MTU的数据包被截断并计入Truncated，MTU不超过MaxMTU
+func TestMTUTruncated(t *testing.T) {
+	//
+	if u := testTransmission(t, WithMTU(MaxMTU+1)); MaxMTU != u.MTU() {
+		t.Fatalf("mtu %d, expected %d", u.MTU(), MaxMTU)
+	} else {
+		u.Close()
+	}
+	//
+	echo := testEchoServer(t)
+	//
+	defer echo.Close()
+	//
+	f, err := NewUDPForwarder("127.0.0.1:0", []string{echo.LocalAddr().String()}, time.Second, WithMTU(100))
+	//
+	if nil != err {
+		t.Fatal(err)
+	}
+	//
+	defer f.Close()
+	//
+	conn, reply := testRoundTrip(t, f, make([]byte, 100))
+	//
+	conn.Close()
+	//
+	if 100 != len(reply) || 0 != f.u.Truncated() {
+		t.Fatalf("reply %d bytes, %d truncated", len(reply), f.u.Truncated())
+	}
+	//
+	conn, reply = testRoundTrip(t, f, make([]byte, 200))
+	//
+	conn.Close()
+	//
+	if 100 != len(reply) || 1 != f.u.Truncated() {
+		t.Fatalf("reply %d bytes, %d truncated", len(reply), f.u.Truncated())
+	}
+}